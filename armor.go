@@ -0,0 +1,232 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// An armored blob carries the binary blob as text, for web views, emailed
+// patches and review tools that mangle or hide binary files:
+//
+//	-----BEGIN GITENC MESSAGE-----
+//	Version: 1
+//
+//	<base64 binary blob, 64 columns>
+//	=<base64 checksum>
+//	-----END GITENC MESSAGE-----
+//
+// The checksum is computed as for exported keys. It catches damage in
+// transit with a clear error, the blob inside is authenticated either way.
+// The encoding is chosen with git config gitenc.encoding, or per file with
+// the gitenc-encoding attribute.
+
+const (
+	armorMessage = "GITENC MESSAGE"
+	// armorLineBytes is how much of the blob goes on a line of 64 columns.
+	armorLineBytes = 48
+	// MaxPeekSize is what PeekHeader may need buffered, enough for the
+	// largest header of an armored blob.
+	MaxPeekSize = (MaxHeaderSize+armorLineBytes-1)/armorLineBytes*65 + 256
+)
+
+var (
+	armorMessageBegin = "-----BEGIN " + armorMessage + "-----"
+	armorMessageEnd   = "-----END " + armorMessage + "-----"
+)
+
+// ParseEncoding reports whether name selects armored blobs.
+func ParseEncoding(name string) (bool, error) {
+	switch name {
+	case "", "binary":
+		return false, nil
+	case "armor":
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown encoding %q, use binary or armor", name)
+}
+
+func isArmoredBlob(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(armorMessageBegin))
+}
+
+type armorWriter struct {
+	w    *bufio.Writer
+	sum  hash.Hash
+	line [armorLineBytes]byte
+	n    int
+}
+
+func newArmorWriter(w io.Writer) (*armorWriter, error) {
+	a := &armorWriter{w: bufio.NewWriter(w), sum: sha256.New()}
+	headers := []string{"Version: " + strconv.Itoa(armorVersion)}
+	a.w.WriteString(armorMessageBegin + "\n")
+	for _, line := range headers {
+		io.WriteString(a.sum, line+"\n")
+		a.w.WriteString(line + "\n")
+	}
+	_, err := a.w.WriteString("\n")
+	return a, err
+}
+
+func (a *armorWriter) Write(b []byte) (int, error) {
+	a.sum.Write(b)
+	written := 0
+	for len(b) > 0 {
+		n := copy(a.line[a.n:], b)
+		a.n += n
+		written += n
+		b = b[n:]
+		if a.n == len(a.line) {
+			if err := a.writeLine(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (a *armorWriter) writeLine() error {
+	if a.n == 0 {
+		return nil
+	}
+	_, err := a.w.WriteString(base64.StdEncoding.EncodeToString(a.line[:a.n]) + "\n")
+	a.n = 0
+	return err
+}
+
+// Close writes the checksum and the end line.
+func (a *armorWriter) Close() error {
+	if err := a.writeLine(); err != nil {
+		return err
+	}
+	a.w.WriteString("=" + base64.StdEncoding.EncodeToString(a.sum.Sum(nil)[:armorChecksum]) + "\n")
+	a.w.WriteString(armorMessageEnd + "\n")
+	return a.w.Flush()
+}
+
+// armorReader decodes an armored blob and checks its checksum when it
+// reaches the end.
+type armorReader struct {
+	r    *bufio.Reader
+	sum  hash.Hash
+	buf  []byte
+	done bool
+}
+
+func newArmorReader(r io.Reader) (*armorReader, error) {
+	a := &armorReader{r: bufio.NewReader(r), sum: sha256.New()}
+	if line, err := a.readLine(); err != nil || line != armorMessageBegin {
+		return nil, ErrNotEncrypted
+	}
+	version := ""
+	for {
+		line, err := a.readLine()
+		if err != nil {
+			return nil, errors.New("armored blob is truncated")
+		}
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid armored blob header: %s", line)
+		}
+		if name == "Version" {
+			version = strings.TrimSpace(value)
+		}
+		io.WriteString(a.sum, line+"\n")
+	}
+	if version != strconv.Itoa(armorVersion) {
+		return nil, fmt.Errorf("unsupported armored blob version %q", version)
+	}
+	return a, nil
+}
+
+// readLine returns the next line without its line ending, which may have
+// been changed to CRLF on the way.
+func (a *armorReader) readLine() (string, error) {
+	line, err := a.r.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimSpace(line), err
+}
+
+func (a *armorReader) Read(b []byte) (int, error) {
+	for len(a.buf) == 0 {
+		if a.done {
+			return 0, io.EOF
+		}
+		line, err := a.readLine()
+		if err == io.EOF {
+			return 0, errors.New("armored blob is truncated")
+		} else if err != nil {
+			return 0, err
+		}
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "="):
+			sum, err := base64.StdEncoding.DecodeString(line[1:])
+			if err != nil || !hmac.Equal(sum, a.sum.Sum(nil)[:armorChecksum]) {
+				return 0, errors.New("armored blob checksum mismatch")
+			}
+			if line, err := a.readLine(); err != nil || line != armorMessageEnd {
+				return 0, errors.New("armored blob is truncated")
+			}
+			a.done = true
+		default:
+			data, err := base64.StdEncoding.DecodeString(line)
+			if err != nil {
+				return 0, fmt.Errorf("invalid armored blob: %v", err)
+			}
+			a.sum.Write(data)
+			a.buf = data
+		}
+	}
+	n := copy(b, a.buf)
+	a.buf = a.buf[n:]
+	return n, nil
+}
+
+// peekArmored decodes the start of the armored blob at the start of r,
+// as far as r can buffer it, without consuming it.
+func peekArmored(r *bufio.Reader) []byte {
+	data, _ := r.Peek(MaxPeekSize)
+	a, err := newArmorReader(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	// the last line may be cut off, what was decoded before it is enough
+	decoded, _ := io.ReadAll(io.LimitReader(a, MaxHeaderSize))
+	return decoded
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"fmt"
+	log "gitenc/log"
+	"strings"
+
+	"github.com/tyler-smith/go-bip39"
+)
+
+// A paper backup is the current key as a BIP39 mnemonic: 24 words from the
+// English list, the last of which carries a checksum of the key. The KDF
+// parameters are not secret and are read back from the blob headers on
+// restore, the keyring is not part of the backup.
+
+const backupColumns = 4
+
+func BackupKey(cmd KeyToolCommand) {
+	exported, err := exportedKeys(cmd.KeyName)
+	if err != nil {
+		log.Error("Error reading key", err)
+		return
+	}
+	mnemonic, err := bip39.NewMnemonic(exported.Keys[0])
+	if err != nil {
+		log.Error("Error encoding key", err)
+		return
+	}
+	log.Info("Key", exported.Name, "with key id", fmt.Sprintf("%x", KeyID(exported.Keys[0])))
+	words := strings.Fields(mnemonic)
+	for i, word := range words {
+		fmt.Printf("%2d. %-10s", i+1, word)
+		if (i+1)%backupColumns == 0 || i == len(words)-1 {
+			fmt.Println()
+		}
+	}
+	if len(exported.Keys) > 1 {
+		log.Warning(len(exported.Keys)-1, "previous keys are not part of the backup, files still encrypted with them need 'gitenc rotate' or 'gitenc key export'")
+	}
+}
+
+// RestoreKey rebuilds the key of keyName from the words of a backup, given
+// as arguments or on stdin. Numbers in front of the words are ignored.
+func RestoreKey(cmd KeyToolCommand, args []string) {
+	text := strings.Join(args, " ")
+	if len(args) == 0 {
+		data, err := readInput("-")
+		if err != nil {
+			log.Error("Error reading words", err)
+			return
+		}
+		text = string(data)
+	}
+	words := make([]string, 0)
+	for _, word := range strings.Fields(strings.ToLower(text)) {
+		if strings.Trim(word, "0123456789.") != "" {
+			words = append(words, word)
+		}
+	}
+	for _, word := range words {
+		if _, ok := bip39.GetWordIndex(word); !ok {
+			log.Error("Unknown word:", word)
+			return
+		}
+	}
+	key, err := bip39.EntropyFromMnemonic(strings.Join(words, " "))
+	if err != nil {
+		log.Error("Invalid backup:", err)
+		return
+	}
+	// shorter mnemonics are valid BIP39 but too short for a key
+	if len(key) != 32 {
+		log.Error("Invalid backup: got", len(words), "words, a backup has 24")
+		return
+	}
+
+	keyPath, keyName := GetKeyPath(cmd.KeyName)
+	header, err := verifyKeys(keyName, [][]byte{key})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	params := &KDFParams{KDF: KDFNone}
+	if header != nil && header.KDF == KDFArgon2id {
+		if params, err = ParseKDFParams(header.KDF, header.KDFParams); err != nil {
+			log.Error(err)
+			return
+		}
+	} else if header != nil && header.KDF == KDFLegacyMD5 {
+		params = &KDFParams{KDF: KDFLegacyMD5}
+	}
+	if err := installKeys(keyPath, keyName, [][]byte{key}, params, cmd.Force); err != nil {
+		log.Error(err)
+		return
+	}
+	log.Info("Key", keyName, "restored, run 'gitenc unlock' to decrypt the files")
+}
@@ -0,0 +1,312 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"os/exec"
+)
+
+type BlobOptions struct {
+	Suite    *CipherSuite
+	Compress *Compressor
+	KeyName  string
+	Params   *KDFParams
+	Mode     byte
+	// Armor writes the blob as text instead of binary.
+	Armor bool
+	// Signer signs the blob, when set.
+	Signer ed25519.PrivateKey
+	// Path and RepoID bind the blob to where it is stored, when set.
+	Path   string
+	RepoID string
+	// Follow holds the settings this clone has no git config for, which
+	// cleanBlob takes from the blob committed for the path.
+	Follow byte
+}
+
+// spoolMemory is how much input is kept in memory before spool moves it to
+// a temporary file.
+const spoolMemory = 4 << 20
+
+// encryptBlob writes the header followed by the compressed and encrypted
+// contents of r to w.
+func encryptBlob(w io.Writer, r io.Reader, key []byte, opts BlobOptions) error {
+	if opts.Armor {
+		armored, err := newArmorWriter(w)
+		if err != nil {
+			return err
+		}
+		opts.Armor = false
+		if err := encryptBlob(armored, r, key, opts); err != nil {
+			return err
+		}
+		return armored.Close()
+	}
+	header := Header{
+		Flags:   FlagStream,
+		Cipher:  opts.Suite.ID,
+		KDF:     opts.Params.KDF,
+		KeyName: opts.KeyName,
+		KeyID:   KeyID(key),
+	}
+	if opts.Params.KDF == KDFArgon2id {
+		header.KDFParams = opts.Params.Bytes()
+	}
+	if opts.Path != "" {
+		header.Flags |= FlagBound
+		header.Path = opts.Path
+		header.RepoID = opts.RepoID
+	}
+	// the signature covers everything written up to it
+	out := w
+	var digest hash.Hash
+	if opts.Signer != nil {
+		header.Flags |= FlagSigned
+		header.Signer = opts.Signer.Public().(ed25519.PublicKey)
+		digest = sha512.New()
+		w = io.MultiWriter(w, digest)
+	}
+	in := bufio.NewReaderSize(r, compressSample)
+	compressor := chooseCompressor(opts.Compress, in)
+	header.Compress = compressor.ID
+	var plaintext io.Reader = in
+	salt := make([]byte, SaltSize)
+	if opts.Mode == ModeDeterministic {
+		// the salt depends on the header and all of the plaintext, so read
+		// it once up front
+		header.Flags |= FlagDeterministic | FlagSyntheticHeader
+		mac := NewSyntheticMAC(key)
+		mac.Write(header.Bytes())
+		spooled, err := spool(in, mac)
+		if err != nil {
+			return err
+		}
+		defer spooled.Close()
+		copy(salt, mac.Sum(nil))
+		plaintext = spooled
+	} else if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return err
+	}
+	sw, err := NewStreamWriter(w, opts.Suite, key, salt, header.AdditionalData())
+	if err != nil {
+		return err
+	}
+	cw, err := compressor.NewWriter(sw)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(cw, plaintext); err != nil {
+		return fmt.Errorf("unable to compress plaintext: %v", err)
+	}
+	if err := cw.Close(); err != nil {
+		return fmt.Errorf("unable to close %s writer: %v", compressor.Name, err)
+	}
+	if err := sw.Close(); err != nil {
+		return err
+	}
+	if digest != nil {
+		_, err = out.Write(ed25519.Sign(opts.Signer, signedMessage(digest.Sum(nil))))
+	}
+	return err
+}
+
+// decryptBlob writes the plaintext of payload to w. Streamed blobs are
+// written out chunk by chunk as they are authenticated, so w may have
+// received data when an error is returned.
+func decryptBlob(w io.Writer, header *Header, payload io.Reader, key []byte) error {
+	suite, err := CipherSuiteByID(header.Cipher)
+	if err != nil {
+		return err
+	}
+	if !header.Streamed() {
+		// blobs from before streaming were always sealed with AES-GCM
+		if suite.ID != CipherAES256GCM {
+			return fmt.Errorf("unsupported cipher %d", header.Cipher)
+		}
+		data, err := io.ReadAll(payload)
+		if err != nil {
+			return err
+		}
+		plaintext, err := Decrypt(data, key, header.Mode())
+		if err != nil {
+			return err
+		}
+		// newer blobs rely on the GCM tag alone
+		if fhash := Hash(plaintext); header.FileHash != nil && !bytes.Equal(header.FileHash, fhash[:]) {
+			return errors.New("file hash mismatch")
+		}
+		_, err = w.Write(plaintext)
+		return err
+	}
+
+	compressID := header.Compress
+	if compressID == 0 {
+		compressID = CompressGzip
+	}
+	compressor, err := CompressorByID(compressID)
+	if err != nil {
+		return err
+	}
+	sr, err := NewStreamReader(payload, suite, key, header.AdditionalData())
+	if err != nil {
+		return err
+	}
+	cr, err := compressor.NewReader(sr)
+	if err != nil {
+		return fmt.Errorf("error creating %s reader: %v", compressor.Name, err)
+	}
+	defer cr.Close()
+	var mac hash.Hash
+	if header.Mode() == ModeDeterministic {
+		mac = NewSyntheticMAC(key)
+		// older deterministic blobs derived the salt from the plaintext only
+		if header.Flags&FlagSyntheticHeader != 0 {
+			mac.Write(header.Raw())
+		}
+		w = io.MultiWriter(w, mac)
+	}
+	if _, err := io.Copy(w, cr); err != nil {
+		return fmt.Errorf("error decompressing data: %v", err)
+	}
+	// read on to the end of the stream, which checks the last chunk
+	if n, err := io.Copy(io.Discard, sr); err != nil {
+		return err
+	} else if n > 0 {
+		return errors.New("trailing data after compressed stream")
+	}
+	if mac != nil && !hmac.Equal(sr.Salt(), mac.Sum(nil)[:SaltSize]) {
+		return errors.New("synthetic nonce mismatch")
+	}
+	return nil
+}
+
+// checkBinding reports an error when a bound blob is found at another path
+// or in another repository than the one it was encrypted for.
+func checkBinding(header *Header, path string, repoID string) error {
+	if !header.Bound() {
+		return nil
+	}
+	if path != "" && header.Path != NormalizePath(path) {
+		return fmt.Errorf("%s was encrypted for %s, it may have been moved or replaced. Run 'gitenc doctor --fix' after a legitimate rename", NormalizePath(path), header.Path)
+	}
+	if header.RepoID != repoID {
+		return fmt.Errorf("%s was encrypted for repository %q, not %q", header.Path, header.RepoID, repoID)
+	}
+	return nil
+}
+
+type spoolFile struct {
+	*os.File
+}
+
+func (f spoolFile) Close() error {
+	f.File.Close()
+	return os.Remove(f.Name())
+}
+
+// spool reads r to the end while feeding it to mac and returns a reader over
+// the same data. Small inputs stay in memory, larger ones go to a temporary
+// file inside the git directory.
+func spool(r io.Reader, mac io.Writer) (io.ReadCloser, error) {
+	var buf bytes.Buffer
+	if _, err := io.CopyN(io.MultiWriter(&buf, mac), r, spoolMemory); err == io.EOF {
+		return io.NopCloser(&buf), nil
+	} else if err != nil {
+		return nil, err
+	}
+	// a key from the environment works without gitenc's directory
+	if err := os.MkdirAll(GetGitPath()+"/gitenc", 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(GetGitPath()+"/gitenc", "spool-")
+	if err != nil {
+		return nil, err
+	}
+	spooled := spoolFile{f}
+	if _, err := buf.WriteTo(f); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	if _, err := io.Copy(io.MultiWriter(f, mac), r); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	return spooled, nil
+}
+
+// fileHeader reads the header of a file in the working tree.
+func fileHeader(file string) (*Header, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header, _, err := PeekHeader(bufio.NewReaderSize(f, MaxPeekSize))
+	return header, err
+}
+
+// blobHeader reads the header of a git object without loading the whole
+// blob.
+func blobHeader(object string) (*Header, error) {
+	header, _, err := blobFormat(object)
+	return header, err
+}
+
+// blobFormat reads the header of a git object like blobHeader and reports
+// whether the blob is armored.
+func blobFormat(object string) (*Header, bool, error) {
+	// git cat-file blob object_id
+	cmd := exec.Command("git", "cat-file", "blob", object)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, false, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, false, err
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	in := bufio.NewReaderSize(out, MaxPeekSize)
+	header, _, err := PeekHeader(in)
+	begin, _ := in.Peek(len(armorMessageBegin))
+	return header, isArmoredBlob(begin), err
+}
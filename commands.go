@@ -21,60 +21,130 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	log "gitenc/log"
-	"io/ioutil"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
-	"unsafe"
 )
 
-type HEADER struct {
-	flag    [4]byte
-	version byte
-	khash   [16]byte
-	fhash   [16]byte
-	size    uint64
-}
+// repoIDFile holds the repository id, relative to the repository root.
+const repoIDFile = "/.gitenc/repoid"
 
 func blobIsEncrypted(blob string) bool {
-	_, output := RunCommand("git", "cat-file", "blob", blob)
-	data := []byte(output)
-	if len(data) > int(unsafe.Sizeof(HEADER{})) {
-		header := (*HEADER)(unsafe.Pointer(&data[0]))
-		if header.flag == [4]byte{0, 'M', 'R', 0} && header.version == 1 {
-			return true
-		}
+	_, err := blobHeader(blob)
+	return err == nil
+}
+
+var errKeyMismatch = errors.New("gitenc key is not the same as the one used to encrypt the file")
+
+// Every key has its own filter and diff driver, gitenc-<keyname>, so that
+// .gitattributes can encrypt different paths under different keys. The
+// primary key, the one 'gitenc init' was run with, also answers to the
+// plain gitenc driver.
+
+func primaryKeyName() string {
+	if name := GetGitConfig("gitenc.keyname"); name != "" {
+		return name
 	}
-	return false
+	return "default"
 }
+
+// keyDrivers returns the drivers that encrypt with keyName.
+func keyDrivers(keyName string) []string {
+	drivers := []string{"gitenc-" + keyName}
+	if keyName == primaryKeyName() {
+		drivers = append(drivers, "gitenc")
+	}
+	return drivers
+}
+
+// driverKeyName returns the key a driver encrypts with, or false when it is
+// not a gitenc driver.
+func driverKeyName(driver string) (string, bool) {
+	if driver == "gitenc" {
+		return primaryKeyName(), true
+	}
+	if name, ok := cutPrefix(driver, "gitenc-"); ok && name != "" {
+		return name, true
+	}
+	return "", false
+}
+
 func ClearGitConfig(name string) {
-	ex, _ := os.Executable()
-	ex = "'" + ex + "'"
-	// git config --unset filter.gitenc.clean
-	RunCommand("git", "config", "--unset", "filter.gitenc.clean")
-	// git config --unset filter.gitenc.smudge
-	RunCommand("git", "config", "--unset", "filter.gitenc.smudge")
-	// git config --unset filter.gitenc.required
-	RunCommand("git", "config", "--unset", "filter.gitenc.required")
-	// git config --unset diff.gitenc.textconv
-	RunCommand("git", "config", "--unset", "diff.gitenc.textconv")
+	for _, driver := range keyDrivers(name) {
+		// git config --unset filter.gitenc.clean
+		RunCommand("git", "config", "--unset", "filter."+driver+".clean")
+		// git config --unset filter.gitenc.smudge
+		RunCommand("git", "config", "--unset", "filter."+driver+".smudge")
+		// git config --unset filter.gitenc.process
+		RunCommand("git", "config", "--unset", "filter."+driver+".process")
+		// git config --unset filter.gitenc.required
+		RunCommand("git", "config", "--unset", "filter."+driver+".required")
+		// git config --unset diff.gitenc.textconv
+		RunCommand("git", "config", "--unset", "diff."+driver+".textconv")
+	}
 }
 func SetGitConfig(name string) {
 	ex, _ := os.Executable()
 	ex = "'" + ex + "'"
-	// git config filter.gitenc.smudge "gitenc smudge %f"
-	RunCommand("git", "config", "filter.gitenc.smudge", ex+" smudge -keyname "+name)
-	// git config filter.gitenc.clean "gitenc clean %f"
-	RunCommand("git", "config", "filter.gitenc.clean", ex+" clean -keyname "+name)
-	// git config filter.gitenc.required true
-	RunCommand("git", "config", "filter.gitenc.required", "true")
-	// git config diff.gitenc.textconv "gitenc diff %f"
-	RunCommand("git", "config", "diff.gitenc.textconv", ex+" diff -keyname "+name)
+	for _, driver := range keyDrivers(name) {
+		// git config filter.gitenc.smudge "gitenc smudge %f"
+		RunCommand("git", "config", "filter."+driver+".smudge", ex+" smudge -keyname "+name+" %f")
+		// git config filter.gitenc.clean "gitenc clean %f"
+		RunCommand("git", "config", "filter."+driver+".clean", ex+" clean -keyname "+name+" %f")
+		// git config filter.gitenc.process "gitenc filter-process"
+		// git uses it when it knows the protocol, the commands above otherwise
+		RunCommand("git", "config", "filter."+driver+".process", ex+" filter-process -keyname "+name)
+		// git config filter.gitenc.required true
+		RunCommand("git", "config", "filter."+driver+".required", "true")
+		// git config diff.gitenc.textconv "gitenc diff %f"
+		RunCommand("git", "config", "diff."+driver+".textconv", ex+" diff -keyname "+name)
+	}
+}
+
+// fileDriver returns the filter driver of file when its diff driver is the
+// same, as it is for encrypted files.
+func fileDriver(file string) string {
+	// git check-attr filter diff -- filename
+	_, output := RunCommand("git", "check-attr", "filter", "diff", "--", file)
+	attrs := strings.Fields(string(output))
+	if len(attrs) < 6 || attrs[2] != attrs[5] {
+		return ""
+	}
+	return attrs[2]
+}
+
+// fileKeyName returns the key file is encrypted with according to its
+// attributes, or false when it is not encrypted by gitenc.
+func fileKeyName(file string) (string, bool) {
+	return driverKeyName(fileDriver(file))
+}
+
+// plainDriverKeyName returns the key name recorded in the blobs of the
+// plain gitenc driver, which is how clones learn their primary key.
+func plainDriverKeyName() string {
+	//git ls-files -cz -- .
+	_, output := RunCommand("git", "ls-files", "-cz", "--", getRepoRoot())
+	for _, file := range strings.Split(output, "\000") {
+		if file == "" || fileDriver(file) != "gitenc" {
+			continue
+		}
+		if header, err := blobHeader(":" + file); err == nil {
+			return header.KeyName
+		}
+	}
+	return ""
 }
-func getEncryptFiles() []string {
+
+// getEncryptFiles returns the files in the index that are encrypted with
+// keyName, or with any key when keyName is empty.
+func getEncryptFiles(keyName string) []string {
 	//git ls-files -cz -- .
 	_, output := RunCommand("git", "ls-files", "-cz", "--", getRepoRoot())
 	fileList := bytes.Split([]byte(output), []byte("\000"))
@@ -87,12 +157,7 @@ func getEncryptFiles() []string {
 		if fields[0] == "?" {
 			continue
 		}
-		// git check-attr filter diff -- filename
-		_, output := RunCommand("git", "check-attr", "filter", "diff", "--", fields[0])
-		attrs := strings.Fields(string(output))
-		filter, diff := attrs[2], attrs[5]
-
-		if filter == "gitenc" && diff == "gitenc" {
+		if name, ok := fileKeyName(fields[0]); ok && (keyName == "" || name == keyName) {
 			encrypted = append(encrypted, fields[0])
 		}
 	}
@@ -121,16 +186,20 @@ func getUserInput() bool {
 
 func Lock(command KeyCommand) {
 	//log.Warning("gitenc lock is not implemented yet.")
-	keyPath, _, _ := getKey(command)
+	keyPath, keyName := GetKeyPath(command.KeyName)
 	if _, err := os.Stat(keyPath); err != nil {
 		log.Error("gitenc isnot initialized in this repository. Run 'gitenc init' to initialize it.")
 		return
 	}
-	encryptFiles := getEncryptFiles()
-	ClearGitConfig(command.KeyName)
+	encryptFiles := getEncryptFiles(keyName)
+	ClearGitConfig(keyName)
 	for _, file := range encryptFiles {
+		// remove the plaintext, git would skip files whose stat info
+		// matches the index
+		os.Remove(file)
 		RunCommand("git", "checkout", "--", file)
 	}
+	forgetProtection(keyPath + keyName)
 
 	if getUserInput() {
 		RunCommand("git", "rm", "-r", "--cached", "--", getRepoRoot())
@@ -139,34 +208,94 @@ func Lock(command KeyCommand) {
 }
 
 func Unlock(command KeyCommand) {
-	keyPath, keyName, key := getKey(command)
-	if _, err := os.Stat(keyPath); err != nil {
-		log.Error("gitenc isnot initialized in this repository. Run 'gitenc init' to initialize it.")
+	input, err := readKeyInput(command)
+	if err != nil {
+		log.Error("Error reading key", err)
 		return
 	}
-	SetGitConfig(keyName)
-	for _, file := range getEncryptFiles() {
-		data, err := os.ReadFile(file)
-		if err != nil {
-			log.Error(err)
-			continue
+	keyPath, keyName := GetKeyPath(command.KeyName)
+	// the filters git runs find a key from the environment as well
+	keys, err := sourceKeys(keyName)
+	if err != nil {
+		log.Error("Error reading key", err)
+		return
+	} else if keys == nil && input {
+		log.Error("The key read is not key", keyName)
+		return
+	}
+	if keys == nil && command.Key == "" && command.Identity == "" && command.SSHIdentity == "" && !fileExists(keyPath+keyName) {
+		if keys, err = helperKeys(keyName); err != nil {
+			log.Error("Error reading key", err)
+			return
 		}
-
-		if len(data) > int(unsafe.Sizeof(HEADER{})) {
-			header := (*HEADER)(unsafe.Pointer(&data[0]))
-			if header.flag == [4]byte{0, 'M', 'R', 0} && header.version == 1 {
-				if header.khash != Hash(key) {
-					log.Error("gitenc key is not the same as the one used to encrypt the file.")
-					break
+		// forget a key that is not the one of this repository, as git does
+		// with rejected credentials
+		if keys != nil {
+			if _, err := verifyKeys(keyName, keys); err != nil {
+				log.Error("The key helper gave the wrong key:", err)
+				eraseHelperKey(keyName)
+				return
+			}
+		} else if keys, err = transitKeys(keyName); err != nil {
+			log.Error("Error unwrapping key", err)
+			return
+		}
+	}
+	if keys == nil {
+		if fileExists(keyPath + keyName) {
+			if _, err := protectionOf(keyPath + keyName); err != nil {
+				log.Error("Error unlocking key", err)
+				return
+			}
+		}
+		if command.Identity != "" || command.SSHIdentity != "" || !fileExists(keyPath+keyName) {
+			identityPath := command.Identity
+			if command.SSHIdentity != "" {
+				identityPath = command.SSHIdentity
+			}
+			if identityPath == "" && fileExists(DefaultIdentityPath()) {
+				identityPath = DefaultIdentityPath()
+			}
+			if identityPath != "" {
+				if err := unlockWithIdentity(keyPath, keyName, identityPath, command.Force); err != nil {
+					log.Error("Error unwrapping key", err)
+					return
 				}
-				log.Info("Decrypting file: " + file)
-				// git add -- filename
-				RunCommand("git", "add", "--", file)
-				// git checkout -- filename
-				RunCommand("git", "checkout", "--", file)
-				continue
 			}
 		}
+		var key []byte
+		keyPath, keyName, key = getKey(command)
+		if _, err := os.Stat(keyPath); err != nil {
+			log.Error("gitenc isnot initialized in this repository. Run 'gitenc init' to initialize it.")
+			return
+		}
+		keys = [][]byte{key}
+	}
+	keys = append(keys, loadOldKeys(keyPath, keyName)...)
+	// clones of a repository initialized with -keyname learn their primary
+	// key from the blobs
+	if GetGitConfig("gitenc.keyname") == "" && keyName != primaryKeyName() && plainDriverKeyName() == keyName {
+		RunCommand("git", "config", "gitenc.keyname", keyName)
+	}
+	SetGitConfig(keyName)
+	for _, file := range getEncryptFiles(keyName) {
+		if header, err := fileHeader(file); err == nil {
+			if _, err := findKey(header, keys); err != nil {
+				log.Error(err)
+				break
+			}
+			log.Info("Decrypting file: " + file)
+			// git skips files whose stat info matches the index, so remove
+			// the ciphertext to have it smudged again
+			os.Remove(file)
+			// git checkout -- filename
+			_, output := RunCommand("git", "checkout", "--", file)
+			// the smudge filter passes blobs it cannot decrypt through
+			if _, err := fileHeader(file); err == nil {
+				log.Error(file, "is still encrypted:", Trim(output))
+			}
+			continue
+		}
 	}
 
 	if getUserInput() {
@@ -186,6 +315,10 @@ func Doctor(cmd DoctorCommand) {
 	fileList := bytes.Split([]byte(output), []byte("\000"))
 	encrypted := make([]string, 0)
 	unencrypted := make([]string, 0)
+	_, prefix := RunCommand("git", "rev-parse", "--show-prefix")
+	prefix = Trim(prefix)
+	id := repoID()
+	revoked := revokedKeys()
 	for _, fileInfo := range fileList {
 		if len(fileInfo) == 0 {
 			continue
@@ -202,11 +335,43 @@ func Doctor(cmd DoctorCommand) {
 		}
 		attrs := strings.Fields(string(output))
 		filter, diff := attrs[2], attrs[5]
+		keyName, isDriver := driverKeyName(filter)
 
-		if filter == "gitenc" && diff == "gitenc" {
+		if isDriver && filter == diff {
 			encrypted = append(encrypted, fields[4])
 			// git cat-file blob object_id
-			if blobIsEncrypted(fields[2]) {
+			if header, err := blobHeader(fields[2]); err == nil {
+				if recipient, ok := revoked[hex.EncodeToString(header.KeyID)]; ok {
+					log.Warning("File is encrypted with a key revoked from", recipient+":", fields[4], ". Run 'gitenc rotate' to re-encrypt it")
+				}
+				if err := checkSigner(header); err != nil {
+					log.Warning(fields[4], "is", err.Error()+". Run 'gitenc verify-signatures' for details")
+				}
+				if header.Signed() {
+					// git cat-file blob object_id
+					if _, err := verifyBlobSignature(fields[2]); err != nil {
+						log.Warning(fields[4]+":", err)
+					}
+				}
+				bindErr := checkBinding(header, prefix+fields[4], id)
+				if header.KeyName != "" && header.KeyName != keyName {
+					bindErr = fmt.Errorf("%s is encrypted with key %s, but its attributes select key %s", fields[4], header.KeyName, keyName)
+				}
+				if bindErr == nil {
+					continue
+				}
+				if !cmd.Fix {
+					log.Warning(bindErr)
+					continue
+				}
+				// git add --renormalize -- filename
+				RunCommand("git", "add", "--renormalize", "--", fields[4])
+				_, output = RunCommand("git", "ls-files", "-sz", fields[4])
+				if header, err := blobHeader(strings.Fields(output)[1]); err == nil && checkBinding(header, prefix+fields[4], id) == nil && header.KeyName == keyName {
+					log.Info("Re-encrypted file:", fields[4])
+				} else {
+					log.Error("Failed to fix file:", fields[4])
+				}
 				continue
 			}
 
@@ -252,20 +417,54 @@ func Init(command KeyCommand) {
 		log.Error(res)
 		return
 	}
-	keyPath, keyName, key := getKey(command)
+	keyPath, keyName := GetKeyPath(command.KeyName)
 	if _, err := os.Stat(keyPath); err == nil {
 		log.Error("gitenc is already initialized")
 		return
 	}
-	if err := os.MkdirAll(keyPath, 0700); err != nil {
-		log.Error("Error creating key directory", err)
+	key, params, old, err := newKey(command, keyName)
+	if err != nil {
+		log.Error("Error generating key", err)
 		return
 	}
-	if err := os.WriteFile(keyPath+keyName, key, 0600); err != nil {
+	if command.Protect {
+		// seal the key before it is first written, writeKey keeps it that way
+		protection, err := askProtection(command)
+		if err != nil {
+			log.Error("Error protecting key", err)
+			return
+		}
+		if err := os.MkdirAll(keyPath, 0700); err != nil {
+			log.Error("Error writing key", err)
+			return
+		}
+		if err := writeKeyFile(keyPath+keyName, key, protection); err != nil {
+			log.Error("Error writing key", err)
+			return
+		}
+		if err := protection.cache(); err != nil {
+			log.Error("Error caching key", err)
+			return
+		}
+	}
+	for _, oldKey := range old {
+		if err := saveOldKey(keyPath, keyName, oldKey); err != nil {
+			log.Error("Error writing key", err)
+			return
+		}
+	}
+	if err := writeKey(keyPath, keyName, key, params); err != nil {
 		log.Error("Error writing key", err)
 		return
 	}
-	os.WriteFile(".gitattributes", []byte("* filter=gitenc diff=gitenc\n.gitattributes !filter !diff"), 0600)
+	if !setRepoOptions(command) {
+		return
+	}
+	if command.KeyName != "" {
+		// the plain gitenc driver encrypts with this key
+		RunCommand("git", "config", "gitenc.keyname", keyName)
+	}
+	os.WriteFile(".gitattributes", []byte("* filter=gitenc diff=gitenc\n.gitattributes !filter !diff\n"+gitencAttributes+"\n"), 0600)
 	log.Info("gitenc initialized")
 
 	command.KeyName = keyName
@@ -276,14 +475,13 @@ func getKey(command KeyCommand) (string, string, []byte) {
 	keyPath, keyName := GetKeyPath(command.KeyName)
 	var key []byte
 	if _, err := os.Stat(keyPath + keyName); err != nil {
-		if command.Key == "" {
-			key := make([]byte, 32)
-			rand.Read(key)
-			command.Key = string(key)
+		key, _, _, err = newKey(command, keyName)
+		if err != nil {
+			log.Error("Error generating key", err)
+			return "", "", nil
 		}
-		key = GenerateKey(command.Key)
 	} else {
-		key, err = os.ReadFile(keyPath + keyName)
+		key, err = readKeyFile(keyPath + keyName)
 		if err != nil {
 			log.Error("Error reading key", err)
 			return "", "", nil
@@ -293,127 +491,263 @@ func getKey(command KeyCommand) (string, string, []byte) {
 	return keyPath, keyName, key
 }
 
-func Smudge(cmd KeyCommand) {
-	// Read header from stdin
-	headerBytes, err := ioutil.ReadAll(os.Stdin)
+func Smudge(cmd KeyCommand, file string) {
+	keyPath, keyName := GetKeyPath(cmd.KeyName)
+	keys, err := loadKeys(keyPath, keyName)
+	if err := smudgeBlob(os.Stdout, os.Stdin, keys, err, file, repoID()); err != nil {
+		log.Error("Error decrypting", err)
+		os.Exit(1)
+	}
+}
 
+// smudgeBlob writes the plaintext of the blob read from r to w. Blobs that
+// are not encrypted, or not with one of keys, are passed through so that a
+// checkout without the key still works; keysErr is why keys could not be
+// loaded. Only a blob that fails to decrypt is an error.
+func smudgeBlob(w io.Writer, r io.Reader, keys [][]byte, keysErr error, file, repoID string) error {
+	in := bufio.NewReaderSize(r, MaxPeekSize)
+	header, size, err := PeekHeader(in)
 	if err != nil {
-		log.Error("Error reading header", err)
-		return
-	}
-	header := (*HEADER)(unsafe.Pointer(&headerBytes[0]))
-	// Read encrypted data from stdin
-	if header.flag != [4]byte{0, 'M', 'R', 0} || header.version != 1 {
 		log.Warning("File is not encrypted. please run 'gitenc doctor' to fix it.")
-		os.Stdout.Write(headerBytes)
-		return
+		io.Copy(w, in)
+		return nil
 	}
-	input := headerBytes[unsafe.Sizeof(*header):]
 	// Decrypt data
-	keyPath, keyName := GetKeyPath(cmd.KeyName)
-	key, err := os.ReadFile(keyPath + keyName)
-	if err != nil {
+	if keysErr == errKeyLocked {
+		log.Warning(keysErr)
+		io.Copy(w, in)
+		return nil
+	} else if keysErr != nil && !os.IsNotExist(keysErr) {
+		// e.g. the key helper or KMS could not be reached
+		log.Warning("Error reading key", keysErr)
+		io.Copy(w, in)
+		return nil
+	} else if keysErr != nil {
 		log.Warning("File is not encrypted. please run 'gitenc doctor' to fix it.")
-		os.Stdout.Write(headerBytes)
-		return
-	}
-
-	if header.khash != Hash(key) {
-		log.Warning("gitenc key is not the same as the one used to encrypt the file.")
-		os.Stdout.Write(headerBytes)
-		return
+		io.Copy(w, in)
+		return nil
 	}
-
-	plaintext, err := Decrypt(input, key)
+	key, err := findKey(header, keys)
 	if err != nil {
-		log.Error("Error decrypting", err)
-		os.Stdout.Write(headerBytes)
-		return
+		log.Warning(err)
+		io.Copy(w, in)
+		return nil
+	}
+	if err := checkBinding(header, file, repoID); err != nil {
+		log.Error(err)
+		io.Copy(w, in)
+		return nil
+	}
+	if err := checkSigner(header); err != nil {
+		log.Warning(file, "is", err)
 	}
 
-	if header.fhash != Hash(plaintext) {
-		log.Error("File hash mismatch")
-		os.Stdout.Write(headerBytes)
-		return
+	payload, err := header.OpenPayload(in, size)
+	if err != nil {
+		return err
 	}
 	// Write decrypted data to stdout
-	os.Stdout.Write(plaintext)
+	return decryptBlob(w, header, payload, key)
 }
-
 func Diff(cmd KeyCommand, file string) {
-	// Read header from file
-	headerBytes, err := ioutil.ReadFile(file)
-	if err != nil || len(headerBytes) < int(unsafe.Sizeof(HEADER{})) {
-		//log.Error("Error reading file:", err)
-		return
-	}
-	header := (*HEADER)(unsafe.Pointer(&headerBytes[0]))
-
-	if header.flag != [4]byte{0, 'M', 'R', 0} || header.version != 1 {
-		os.Stdout.Write(headerBytes)
+	f, err := os.Open(file)
+	if err != nil {
+		log.Error("Error reading file:", err)
 		return
 	}
-	// Read encrypted data from file
-	dataOffset := int64(unsafe.Sizeof(*header))
-	encryptedData, err := ioutil.ReadFile(file)
+	defer f.Close()
+	in := bufio.NewReaderSize(f, MaxPeekSize)
+	header, size, err := PeekHeader(in)
 	if err != nil {
-		log.Error("Error reading file:", err)
+		io.Copy(os.Stdout, in)
 		return
 	}
-	encryptedData = encryptedData[dataOffset : dataOffset+int64(header.size)]
 
 	// Decrypt data
 	keyPath, keyName := GetKeyPath(cmd.KeyName)
-	key, err := os.ReadFile(keyPath + keyName)
+	keys, err := loadKeys(keyPath, keyName)
 	if err != nil {
 		log.Error("Error reading key", err)
 		return
 	}
-
-	if header.khash != Hash(key) {
-		log.Warning("gitenc key is not the same as the one used to encrypt the file.")
+	key, err := findKey(header, keys)
+	if err != nil {
+		log.Warning(err)
 		return
 	}
 
-	plaintext, err := Decrypt(encryptedData, key)
+	payload, err := header.OpenPayload(in, size)
 	if err != nil {
 		log.Error("Error decrypting", err)
 		return
 	}
-	if header.fhash != Hash(plaintext) {
-		log.Error("Hash mismatch")
-		return
-	}
-
 	// Write decrypted data to stdout
-	os.Stdout.Write(plaintext)
+	if err := decryptBlob(os.Stdout, header, payload, key); err != nil {
+		log.Error("Error decrypting", err)
+	}
 }
 
-func Clean(cmd KeyCommand) {
-	bytes, _ := ioutil.ReadAll(os.Stdin)
+func Clean(cmd KeyCommand, file string) {
 	keyPath, keyName := GetKeyPath(cmd.KeyName)
-	key, err := os.ReadFile(keyPath + keyName)
+	keys, err := loadKeys(keyPath, keyName)
 	if err != nil {
+		// an empty output would be committed in place of the file
 		log.Error("Error reading key", err)
-		return
+		os.Exit(1)
 	}
-	encrypted, err := Encrypt(bytes, key)
+	opts, err := repoBlobOptions(keyPath, keyName)
 	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	if err := cleanBlob(os.Stdout, os.Stdin, keys[0], opts, file); err != nil {
 		log.Error("Error encrypting", err)
+		os.Exit(1)
+	}
+}
+
+// repoBlobOptions returns how the repository encrypts with keyName. The
+// compression and encoding may still be overridden per file.
+func repoBlobOptions(keyPath, keyName string) (BlobOptions, error) {
+	params, err := readKeyParams(keyPath, keyName)
+	if err != nil {
+		return BlobOptions{}, fmt.Errorf("error reading key: %v", err)
+	}
+	var follow byte
+	modeName := GetGitConfig("gitenc.mode")
+	if modeName == "" {
+		follow |= followMode
+	}
+	mode, err := ParseMode(modeName)
+	if err != nil {
+		return BlobOptions{}, err
+	}
+	cipherName := GetGitConfig("gitenc.cipher")
+	if cipherName == "" {
+		follow |= followCipher
+	}
+	suite, err := CipherSuiteByName(cipherName)
+	if err != nil {
+		return BlobOptions{}, err
+	}
+	compressionName := GetGitConfig("gitenc.compression")
+	if compressionName == "" {
+		follow |= followCompression
+	}
+	compressor, err := CompressorByName(compressionName)
+	if err != nil {
+		return BlobOptions{}, err
+	}
+	encodingName := GetGitConfig("gitenc.encoding")
+	if encodingName == "" {
+		follow |= followEncoding
+	}
+	armored, err := ParseEncoding(encodingName)
+	if err != nil {
+		return BlobOptions{}, err
+	}
+	signer, err := repoSigningKey()
+	if err != nil {
+		return BlobOptions{}, err
+	}
+	return BlobOptions{
+		Suite:    suite,
+		Compress: compressor,
+		KeyName:  keyName,
+		Params:   params,
+		Mode:     mode,
+		Armor:    armored,
+		Signer:   signer,
+		RepoID:   repoID(),
+		Follow:   follow,
+	}, nil
+}
+
+// Settings a clone without git config of its own takes from the blob
+// committed for a file, so that cleaning the file again gives the same blob
+// and it does not show as modified.
+const (
+	followMode byte = 1 << iota
+	followCipher
+	followCompression
+	followEncoding
+)
+
+// followCommitted sets the settings in opts.Follow as in the blob
+// committed as object, when there is one.
+func followCommitted(opts *BlobOptions, object string) {
+	header, armored, err := blobFormat(object)
+	if err != nil {
 		return
 	}
-	header := HEADER{
-		flag:    [4]byte{0, 'M', 'R', 0},
-		khash:   Hash(key),
-		fhash:   Hash(bytes),
-		version: 1,
-		size:    uint64(len(encrypted)),
+	if opts.Follow&followEncoding != 0 {
+		opts.Armor = armored
 	}
+	if opts.Follow&followMode != 0 && header.Flags&FlagDeterministic != 0 {
+		opts.Mode = ModeDeterministic
+	}
+	if opts.Follow&followCipher != 0 {
+		if suite, err := CipherSuiteByID(header.Cipher); err == nil {
+			opts.Suite = suite
+		}
+	}
+	// blobs written before the compression was recorded keep the default
+	if opts.Follow&followCompression != 0 {
+		if compressor, err := CompressorByID(header.Compress); err == nil {
+			opts.Compress = compressor
+		}
+	}
+}
 
-	// Write header to stdout
-	os.Stdout.Write((*(*[unsafe.Sizeof(header)]byte)(unsafe.Pointer(&header)))[:])
-	// Write encrypted data to stdout
-	os.Stdout.Write(encrypted)
+// cleanBlob encrypts the contents of file, read from r, to w.
+func cleanBlob(w io.Writer, r io.Reader, key []byte, opts BlobOptions, file string) error {
+	in := bufio.NewReaderSize(r, MaxPeekSize)
+	// files that are still encrypted in the working tree, with this or
+	// another key, must not be encrypted a second time
+	if _, _, err := PeekHeader(in); err == nil {
+		_, err = io.Copy(w, in)
+		return err
+	}
+	attrs := GetGitAttrs(file, "gitenc-mode", "gitenc-cipher", "gitenc-compression", "gitenc-encoding")
+	if mode := attrs["gitenc-mode"]; mode != "" {
+		parsed, err := ParseMode(mode)
+		if err != nil {
+			return err
+		}
+		opts.Mode = parsed
+		opts.Follow &^= followMode
+	}
+	if cipher := attrs["gitenc-cipher"]; cipher != "" {
+		suite, err := CipherSuiteByName(cipher)
+		if err != nil {
+			return err
+		}
+		opts.Suite = suite
+		opts.Follow &^= followCipher
+	}
+	if compression := attrs["gitenc-compression"]; compression != "" {
+		compressor, err := CompressorByName(compression)
+		if err != nil {
+			return err
+		}
+		opts.Compress = compressor
+		opts.Follow &^= followCompression
+	}
+	if encoding := attrs["gitenc-encoding"]; encoding != "" {
+		armored, err := ParseEncoding(encoding)
+		if err != nil {
+			return err
+		}
+		opts.Armor = armored
+		opts.Follow &^= followEncoding
+	}
+	if file != "" {
+		opts.Path = NormalizePath(file)
+		if opts.Follow != 0 {
+			followCommitted(&opts, ":"+opts.Path)
+		}
+	}
+	return encryptBlob(w, in, key, opts)
 }
 
 func Set(cmd KeyCommand) {
@@ -422,18 +756,150 @@ func Set(cmd KeyCommand) {
 		log.Error("gitenc isnot initialized in this repository. Run 'gitenc init' to initialize it.")
 		return
 	}
-	if cmd.Key != "" {
+	// a new key name gets a key of its own, to be used by another driver
+	if cmd.Key != "" || !haveKey(keyPath, keyName) {
 		log.Info("Generating new key...")
-		key := GenerateKey(cmd.Key)
-		if err := os.MkdirAll(keyPath, 0700); err != nil {
-			log.Error("Error creating key directory", err)
+		key, params, old, err := newKey(cmd, keyName)
+		if err != nil {
+			log.Error("Error generating key", err)
 			return
 		}
-		if err := os.WriteFile(keyPath+keyName, key, 0600); err != nil {
+		// keep a legacy MD5 key readable while its blobs are migrated
+		if current, err := readKeyFile(keyPath + keyName); err == nil {
+			if currentParams, err := readKeyParams(keyPath, keyName); err == nil && currentParams.KDF == KDFLegacyMD5 {
+				old = append(old, current)
+			}
+		}
+		for _, oldKey := range old {
+			if err := saveOldKey(keyPath, keyName, oldKey); err != nil {
+				log.Error("Error writing key", err)
+				return
+			}
+		}
+		if err := writeKey(keyPath, keyName, key, params); err != nil {
+			log.Error("Error writing key", err)
+			return
+		}
+	}
+	if cmd.Protect || cmd.Unprotect {
+		var protection *keyProtection
+		if cmd.Protect {
+			var err error
+			if protection, err = askProtection(cmd); err != nil {
+				log.Error("Error protecting key", err)
+				return
+			}
+		}
+		if err := protectKeys(keyPath, keyName, protection); err != nil {
 			log.Error("Error writing key", err)
 			return
 		}
+		if cmd.Protect {
+			log.Info("Key", keyName, "is protected by a passphrase")
+		} else {
+			log.Info("Key", keyName, "is stored without a passphrase")
+		}
+	}
+	if !setRepoOptions(cmd) {
+		return
 	}
-	log.Info("Setting key name to", keyName)
 	SetGitConfig(keyName)
+	for _, driver := range keyDrivers(keyName) {
+		log.Info("Files with filter="+driver, "diff="+driver, "are encrypted with key", keyName)
+	}
+}
+
+func setRepoOptions(command KeyCommand) bool {
+	if command.Mode != "" {
+		if _, err := ParseMode(command.Mode); err != nil {
+			log.Error(err)
+			return false
+		}
+		// git config gitenc.mode deterministic
+		RunCommand("git", "config", "gitenc.mode", command.Mode)
+		log.Info("Encryption mode set to", command.Mode+", set the gitenc-mode attribute in .gitattributes so that clones use it too")
+	}
+	if command.Cipher != "" {
+		if _, err := CipherSuiteByName(command.Cipher); err != nil {
+			log.Error(err)
+			return false
+		}
+		// git config gitenc.cipher xchacha20-poly1305
+		RunCommand("git", "config", "gitenc.cipher", command.Cipher)
+		log.Info("Cipher set to", command.Cipher+", set the gitenc-cipher attribute in .gitattributes so that clones use it too")
+	}
+	if command.Compression != "" {
+		if _, err := CompressorByName(command.Compression); err != nil {
+			log.Error(err)
+			return false
+		}
+		// git config gitenc.compression zstd
+		RunCommand("git", "config", "gitenc.compression", command.Compression)
+		log.Info("Compression set to", command.Compression+", set the gitenc-compression attribute in .gitattributes so that clones use it too")
+	}
+	if command.Encoding != "" {
+		if _, err := ParseEncoding(command.Encoding); err != nil {
+			log.Error(err)
+			return false
+		}
+		// git config gitenc.encoding armor
+		RunCommand("git", "config", "gitenc.encoding", command.Encoding)
+		log.Info("Encoding set to", command.Encoding+", set the gitenc-encoding attribute in .gitattributes so that clones use it too")
+	}
+	if command.Sign {
+		if _, err := readSigningKey(signingKeyPath()); err != nil {
+			log.Error("Error reading signing key", err, "- run 'gitenc keygen -sign' to create one")
+			return false
+		}
+		// git config gitenc.sign true
+		RunCommand("git", "config", "gitenc.sign", "true")
+		log.Info("Encrypted files are signed with", signingKeyPath())
+	} else if command.NoSign {
+		// git config --unset gitenc.sign
+		RunCommand("git", "config", "--unset", "gitenc.sign")
+		log.Info("Encrypted files are no longer signed")
+	}
+	if command.RepoID != "" {
+		// git config gitenc.repoid id
+		RunCommand("git", "config", "gitenc.repoid", command.RepoID)
+		if err := writeRepoID(command.RepoID); err != nil {
+			log.Error("Error writing repository id", err)
+			return false
+		}
+		log.Info("Repository id set to", command.RepoID+", commit", repoIDFile[1:], "so that clones use it too")
+	}
+	return true
+}
+
+// writeRepoID records the repository id in the repository and stages it,
+// git config only lives in this clone.
+func writeRepoID(id string) error {
+	path := getRepoRoot() + repoIDFile
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(id+"\n"), 0644); err != nil {
+		return err
+	}
+	if err := ensureGitencAttributes(); err != nil {
+		return err
+	}
+	// git add -- .gitenc/repoid
+	if code, output := RunCommand("git", "add", "--", path); code != 0 {
+		return errors.New(output)
+	}
+	return nil
+}
+
+// repoID returns the id encrypted files are bound to: git config
+// gitenc.repoid, or the id committed with the repository.
+func repoID() string {
+	if id := GetGitConfig("gitenc.repoid"); id != "" {
+		return id
+	}
+	data, err := readCommittedFile(repoIDFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
 }
@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressor is applied to the plaintext before it is encrypted. Its id is
+// recorded in the header; blobs without one were compressed with gzip.
+type Compressor struct {
+	ID        byte
+	Name      string
+	NewWriter func(w io.Writer) (io.WriteCloser, error)
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var Compressors = []*Compressor{
+	{CompressNone, "none", newNoneWriter, newNoneReader},
+	{CompressGzip, "gzip", newGzipWriter, newGzipReader},
+	{CompressZstd, "zstd", newZstdWriter, newZstdReader},
+}
+
+var (
+	NoCompressor      = Compressors[0]
+	DefaultCompressor = Compressors[1]
+)
+
+// compressSample is how much of the input is test-compressed to decide
+// whether compressing is worth it.
+const compressSample = 128 * 1024
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func newNoneWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func newNoneReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+
+func newGzipWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func newGzipReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func newZstdWriter(w io.Writer) (io.WriteCloser, error) {
+	// a single encoder goroutine keeps the output reproducible
+	return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+}
+
+func newZstdReader(r io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+func CompressorByID(id byte) (*Compressor, error) {
+	for _, c := range Compressors {
+		if c.ID == id {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported compression %d", id)
+}
+
+func CompressorByName(name string) (*Compressor, error) {
+	if name == "" {
+		return DefaultCompressor, nil
+	}
+	for _, c := range Compressors {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown compression: %s", name)
+}
+
+type countWriter struct {
+	n int
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += len(p)
+	return len(p), nil
+}
+
+// chooseCompressor returns c, or no compression when a sample from the start
+// of r does not shrink by at least a few percent, as is the case for images,
+// archives and other already compressed data.
+func chooseCompressor(c *Compressor, r *bufio.Reader) *Compressor {
+	if c.ID == CompressNone {
+		return c
+	}
+	sample, _ := r.Peek(compressSample)
+	if len(sample) == 0 {
+		return c
+	}
+	var out countWriter
+	w, err := c.NewWriter(&out)
+	if err != nil {
+		return c
+	}
+	w.Write(sample)
+	w.Close()
+	if out.n >= len(sample)*95/100 {
+		return NoCompressor
+	}
+	return c
+}
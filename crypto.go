@@ -23,14 +23,15 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
-	"crypto/aes"
-	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/md5"
-	"crypto/rand"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"unsafe"
+
+	"golang.org/x/crypto/hkdf"
 )
 
 func Md5sum(plaintext string) []byte {
@@ -50,38 +51,39 @@ func GenerateKey(key string) []byte {
 	return append(Md5sum(key), Md5sum(ReverseString(key))...)
 }
 
-func Encrypt(plainText []byte, key []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
-	}
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err = rand.Read(nonce); err != nil {
-		return nil, err
-	}
+const (
+	ModeRandom byte = iota
+	ModeDeterministic
+)
 
-	var compressed bytes.Buffer
-	gzWriter := gzip.NewWriter(&compressed)
-	if _, err := gzWriter.Write(plainText); err != nil {
-		return nil, fmt.Errorf("unable to compress plaintext: %v", err)
-	}
-	if err := gzWriter.Close(); err != nil {
-		return nil, fmt.Errorf("unable to close gzip writer: %v", err)
+func ParseMode(s string) (byte, error) {
+	switch s {
+	case "", "random":
+		return ModeRandom, nil
+	case "deterministic":
+		return ModeDeterministic, nil
 	}
-	ciphertext := gcm.Seal(nonce, nonce, compressed.Bytes(), nil)
-	return ciphertext, nil
+	return 0, fmt.Errorf("unknown encryption mode: %s", s)
 }
 
-func Decrypt(cipherText []byte, key []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
-	gcm, err := cipher.NewGCM(block)
+// NewSyntheticMAC returns the MAC that deterministic blobs derive their
+// nonce or salt from, so identical files always produce identical
+// ciphertexts.
+func NewSyntheticMAC(key []byte) hash.Hash {
+	subkey := hmac.New(sha256.New, key)
+	subkey.Write([]byte("gitenc synthetic nonce"))
+	return hmac.New(sha256.New, subkey.Sum(nil))
+}
+
+func SyntheticNonce(key []byte, plainText []byte, size int) []byte {
+	mac := NewSyntheticMAC(key)
+	mac.Write(plainText)
+	return mac.Sum(nil)[:size]
+}
+
+// Decrypt opens payloads written before blobs were streamed.
+func Decrypt(cipherText []byte, key []byte, mode byte) ([]byte, error) {
+	gcm, err := newAESGCM(key)
 	if err != nil {
 		return nil, err
 	}
@@ -105,12 +107,19 @@ func Decrypt(cipherText []byte, key []byte) ([]byte, error) {
 	if _, err := io.Copy(&out, r); err != nil {
 		return nil, fmt.Errorf("error decompressing data: %v", err)
 	}
+	if mode == ModeDeterministic && !hmac.Equal(nonce, SyntheticNonce(key, out.Bytes(), nonceSize)) {
+		return nil, errors.New("synthetic nonce mismatch")
+	}
 	return out.Bytes(), nil
 }
 
+// KeyID identifies a key without revealing anything about it.
+func KeyID(key []byte) []byte {
+	id := make([]byte, 16)
+	io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("gitenc key id")), id)
+	return id
+}
+
 func Hash(data []byte) [16]byte {
-	hash := md5.New()
-	hash.Write(data)
-	sum := hash.Sum(nil)
-	return *(*[16]byte)(unsafe.Pointer(&sum[0]))
+	return md5.Sum(data)
 }
@@ -0,0 +1,335 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	log "gitenc/log"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// An exported key is a text block that survives being pasted into a
+// password manager or an email:
+//
+//	-----BEGIN GITENC KEY-----
+//	Version: 1
+//	Key-Name: default
+//	Key-ID: <hex key id of the current key>
+//	KDF: argon2id
+//	KDF-Params: <base64 kdf parameters>
+//	Keyring: 1
+//
+//	<base64 keys, 64 columns>
+//	=<base64 checksum>
+//	-----END GITENC KEY-----
+//
+// The keys are the current key followed by the keyring, each prefixed with
+// its length. The checksum is the start of the SHA-256 of the header lines
+// and the keys, so typos and truncation are caught before anything is
+// written. Key shares use the same armor with their own headers.
+
+const (
+	armorVersion  = 1
+	armorChecksum = 6
+	armorKey      = "GITENC KEY"
+)
+
+var kdfNames = map[byte]string{
+	KDFNone:      "none",
+	KDFLegacyMD5: "md5",
+	KDFArgon2id:  "argon2id",
+}
+
+type ExportedKey struct {
+	Name   string
+	Params *KDFParams
+	// Keys holds the current key followed by the keyring.
+	Keys [][]byte
+}
+
+// armorBlock is one armored block, the header lines are kept in order since
+// they are covered by the checksum.
+type armorBlock struct {
+	Headers []string
+	Fields  map[string]string
+	Payload []byte
+}
+
+func armorSum(headers []string, payload []byte) []byte {
+	h := sha256.New()
+	for _, line := range headers {
+		io.WriteString(h, line+"\n")
+	}
+	h.Write(payload)
+	return h.Sum(nil)[:armorChecksum]
+}
+
+func armor(kind string, headers []string, payload []byte) string {
+	var out strings.Builder
+	out.WriteString("-----BEGIN " + kind + "-----\n")
+	for _, line := range headers {
+		out.WriteString(line + "\n")
+	}
+	out.WriteString("\n")
+	body := base64.StdEncoding.EncodeToString(payload)
+	for len(body) > 64 {
+		out.WriteString(body[:64] + "\n")
+		body = body[64:]
+	}
+	out.WriteString(body + "\n")
+	out.WriteString("=" + base64.StdEncoding.EncodeToString(armorSum(headers, payload)) + "\n")
+	out.WriteString("-----END " + kind + "-----\n")
+	return out.String()
+}
+
+// parseArmor reads all blocks of kind in text and checks their version and
+// checksum.
+func parseArmor(kind string, text string) ([]*armorBlock, error) {
+	begin, end := "-----BEGIN "+kind+"-----", "-----END "+kind+"-----"
+	blocks := make([]*armorBlock, 0)
+	var block *armorBlock
+	var body strings.Builder
+	var checksum string
+	inBody := false
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == begin:
+			block = &armorBlock{Fields: make(map[string]string)}
+			body.Reset()
+			checksum = ""
+			inBody = false
+		case block == nil:
+			continue
+		case line == end:
+			payload, err := base64.StdEncoding.DecodeString(body.String())
+			if err != nil {
+				return nil, fmt.Errorf("invalid armored data: %v", err)
+			}
+			sum, err := base64.StdEncoding.DecodeString(checksum)
+			if err != nil || !hmac.Equal(sum, armorSum(block.Headers, payload)) {
+				return nil, errors.New("armored data checksum mismatch")
+			}
+			if block.Fields["Version"] != strconv.Itoa(armorVersion) {
+				return nil, fmt.Errorf("unsupported armored data version %q", block.Fields["Version"])
+			}
+			block.Payload = payload
+			blocks = append(blocks, block)
+			block = nil
+		case !inBody && line == "":
+			inBody = true
+		case !inBody:
+			name, value, ok := strings.Cut(line, ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid header line: %s", line)
+			}
+			block.Headers = append(block.Headers, line)
+			block.Fields[name] = strings.TrimSpace(value)
+		case strings.HasPrefix(line, "="):
+			checksum = line[1:]
+		default:
+			body.WriteString(line)
+		}
+	}
+	if block != nil {
+		return nil, errors.New("armored data is truncated")
+	}
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("no %s found", strings.ToLower(kind))
+	}
+	return blocks, nil
+}
+
+// headers returns the header lines describing the keys, without the
+// secret parts.
+func (e *ExportedKey) headers() []string {
+	headers := []string{
+		"Version: " + strconv.Itoa(armorVersion),
+		"Key-Name: " + e.Name,
+		"Key-ID: " + hex.EncodeToString(KeyID(e.Keys[0])),
+		"KDF: " + kdfNames[e.Params.KDF],
+	}
+	if e.Params.KDF == KDFArgon2id {
+		headers = append(headers, "KDF-Params: "+base64.StdEncoding.EncodeToString(e.Params.Bytes()))
+	}
+	return append(headers, "Keyring: "+strconv.Itoa(len(e.Keys)-1))
+}
+
+func (e *ExportedKey) payload() []byte {
+	var payload []byte
+	for _, key := range e.Keys {
+		payload = append(append(payload, byte(len(key))), key...)
+	}
+	return payload
+}
+
+func (e *ExportedKey) Armor() string {
+	return armor(armorKey, e.headers(), e.payload())
+}
+
+// ParseArmoredKey reads the first exported key in text.
+func ParseArmoredKey(text string) (*ExportedKey, error) {
+	blocks, err := parseArmor(armorKey, text)
+	if err != nil {
+		return nil, err
+	}
+	return parseExportedKey(blocks[0].Fields, blocks[0].Payload)
+}
+
+// parseExportedKey checks payload against the fields describing it.
+func parseExportedKey(fields map[string]string, payload []byte) (*ExportedKey, error) {
+	exported := &ExportedKey{Name: fields["Key-Name"]}
+	// the name becomes a file name under .git/gitenc/keys
+	if name := exported.Name; name == "" || name == "." || strings.ContainsAny(name, `/\`) || strings.Contains(name, "..") {
+		return nil, fmt.Errorf("invalid key name %q", name)
+	}
+	for len(payload) > 0 {
+		n := int(payload[0])
+		if n == 0 || len(payload) < 1+n {
+			return nil, errors.New("invalid key data")
+		}
+		exported.Keys = append(exported.Keys, payload[1:1+n])
+		payload = payload[1+n:]
+	}
+	if len(exported.Keys) == 0 || strconv.Itoa(len(exported.Keys)-1) != fields["Keyring"] {
+		return nil, errors.New("key data does not hold the announced keys")
+	}
+	if hex.EncodeToString(KeyID(exported.Keys[0])) != fields["Key-ID"] {
+		return nil, errors.New("key data does not match its key id")
+	}
+	for kdf, name := range kdfNames {
+		if name == fields["KDF"] {
+			exported.Params = &KDFParams{KDF: kdf}
+		}
+	}
+	if exported.Params == nil {
+		return nil, fmt.Errorf("unknown kdf %q", fields["KDF"])
+	}
+	if exported.Params.KDF == KDFArgon2id {
+		data, err := base64.StdEncoding.DecodeString(fields["KDF-Params"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid kdf parameters: %v", err)
+		}
+		if exported.Params, err = ParseKDFParams(KDFArgon2id, data); err != nil {
+			return nil, err
+		}
+	}
+	return exported, nil
+}
+
+// exportedKeys reads the keys of keyName for exporting them.
+func exportedKeys(keyName string) (*ExportedKey, error) {
+	keyPath, keyName := GetKeyPath(keyName)
+	keys, err := unlockKeys(keyPath, keyName)
+	if os.IsNotExist(err) {
+		return nil, errors.New("gitenc isnot initialized in this repository. Run 'gitenc init' to initialize it.")
+	} else if err != nil {
+		return nil, err
+	}
+	params, err := readKeyParams(keyPath, keyName)
+	if err != nil {
+		return nil, err
+	}
+	return &ExportedKey{keyName, params, keys}, nil
+}
+
+func ExportKey(cmd KeyToolCommand) {
+	exported, err := exportedKeys(cmd.KeyName)
+	if err != nil {
+		log.Error("Error reading key", err)
+		return
+	}
+	armored := exported.Armor()
+	if cmd.Output == "" {
+		fmt.Print(armored)
+		return
+	}
+	if err := os.WriteFile(cmd.Output, []byte(armored), 0600); err != nil {
+		log.Error("Error writing key", err)
+		return
+	}
+	log.Info("Key", exported.Name, "exported to", cmd.Output)
+}
+
+func ImportKey(cmd KeyToolCommand, file string) {
+	data, err := readInput(file)
+	if err != nil {
+		log.Error("Error reading exported key", err)
+		return
+	}
+	exported, err := ParseArmoredKey(string(data))
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if cmd.KeyName == "" {
+		cmd.KeyName = exported.Name
+	}
+	keyPath, keyName := GetKeyPath(cmd.KeyName)
+	if err := installKeys(keyPath, keyName, exported.Keys, exported.Params, cmd.Force); err != nil {
+		log.Error(err)
+		return
+	}
+	log.Info("Key", keyName, "imported, run 'gitenc unlock' to decrypt the files")
+}
+
+// installKeys makes keys, the current one first, the keys of keyName. A
+// different current key is only replaced with force, and then kept in the
+// keyring.
+func installKeys(keyPath, keyName string, keys [][]byte, params *KDFParams, force bool) error {
+	if fileExists(keyPath + keyName) {
+		current, err := unlockKeys(keyPath, keyName)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(current[0], keys[0]) {
+			if !force {
+				return fmt.Errorf("key %s already exists and is a different key (%x), use -force to replace it", keyName, KeyID(current[0]))
+			}
+			if err := saveOldKey(keyPath, keyName, current[0]); err != nil {
+				return err
+			}
+		}
+	}
+	for _, key := range keys[1:] {
+		if err := saveOldKey(keyPath, keyName, key); err != nil {
+			return err
+		}
+	}
+	return writeKey(keyPath, keyName, keys[0], params)
+}
+
+// readInput reads file, or stdin when file is empty or "-".
+func readInput(file string) ([]byte, error) {
+	if file == "" || file == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(file)
+}
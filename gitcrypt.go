@@ -0,0 +1,232 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// git-crypt keeps its key in .git/git-crypt/keys/<name>, in the format
+// 'git-crypt export-key' writes, all integers big-endian:
+//
+//	"\0GITCRYPTKEY" | format version (4) = 2 | header fields | entries
+//
+// A field is an id (4), a length (4) and the value, id 0 ends the header
+// and every entry. The header may name the key, entries hold a key
+// version, a 32 byte AES key and a 64 byte HMAC key. Unknown fields with an
+// odd id must be understood, even ones may be skipped. Keys older than the
+// format are just the AES key followed by the HMAC key.
+//
+// An encrypted file is "\0GITCRYPT\0", a 12 byte nonce and the AES-256-CTR
+// ciphertext. The nonce is the start of the HMAC-SHA1 of the plaintext,
+// which is checked once decrypted.
+
+const (
+	gitCryptKeyFormat   = 2
+	gitCryptAESKeySize  = 32
+	gitCryptHMACKeySize = 64
+	gitCryptNonceSize   = 12
+
+	gitCryptFieldEnd     = 0
+	gitCryptFieldKeyName = 1
+	gitCryptFieldVersion = 1
+	gitCryptFieldAESKey  = 3
+	gitCryptFieldHMACKey = 5
+)
+
+var (
+	gitCryptKeyMagic  = []byte("\x00GITCRYPTKEY")
+	gitCryptFileMagic = []byte("\x00GITCRYPT\x00")
+
+	errGitCryptKeyTruncated = errors.New("git-crypt key is truncated")
+)
+
+type gitCryptKey struct {
+	Version uint32
+	AESKey  []byte
+	HMACKey []byte
+}
+
+type gitCryptKeyFile struct {
+	// Name is empty for the default key.
+	Name string
+	Keys []gitCryptKey
+}
+
+func parseGitCryptKey(data []byte) (*gitCryptKeyFile, error) {
+	if !bytes.HasPrefix(data, gitCryptKeyMagic) {
+		if len(data) == gitCryptAESKeySize+gitCryptHMACKeySize {
+			return &gitCryptKeyFile{Keys: []gitCryptKey{{
+				AESKey:  data[:gitCryptAESKeySize],
+				HMACKey: data[gitCryptAESKeySize:],
+			}}}, nil
+		}
+		return nil, errors.New("not a git-crypt key")
+	}
+	r := bytes.NewReader(data[len(gitCryptKeyMagic):])
+	var format uint32
+	if err := binary.Read(r, binary.BigEndian, &format); err != nil {
+		return nil, errGitCryptKeyTruncated
+	}
+	if format != gitCryptKeyFormat {
+		return nil, fmt.Errorf("unsupported git-crypt key format %d", format)
+	}
+	keyFile := &gitCryptKeyFile{}
+	err := readGitCryptFields(r, func(id uint32, value []byte) error {
+		if id == gitCryptFieldKeyName {
+			keyFile.Name = string(value)
+			return nil
+		}
+		return gitCryptUnknownField(id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for r.Len() > 0 {
+		var key gitCryptKey
+		err := readGitCryptFields(r, func(id uint32, value []byte) error {
+			switch id {
+			case gitCryptFieldVersion:
+				if len(value) != 4 {
+					return errors.New("invalid git-crypt key version")
+				}
+				key.Version = binary.BigEndian.Uint32(value)
+			case gitCryptFieldAESKey:
+				if len(value) != gitCryptAESKeySize {
+					return errors.New("invalid git-crypt AES key")
+				}
+				key.AESKey = value
+			case gitCryptFieldHMACKey:
+				if len(value) != gitCryptHMACKeySize {
+					return errors.New("invalid git-crypt HMAC key")
+				}
+				key.HMACKey = value
+			default:
+				return gitCryptUnknownField(id)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if key.AESKey == nil || key.HMACKey == nil {
+			return nil, errors.New("git-crypt key entry without keys")
+		}
+		keyFile.Keys = append(keyFile.Keys, key)
+	}
+	if len(keyFile.Keys) == 0 {
+		return nil, errors.New("git-crypt key file holds no keys")
+	}
+	return keyFile, nil
+}
+
+// readGitCryptFields passes the fields up to the next end field to set.
+func readGitCryptFields(r *bytes.Reader, set func(id uint32, value []byte) error) error {
+	for {
+		var id, size uint32
+		if err := binary.Read(r, binary.BigEndian, &id); err != nil {
+			return errGitCryptKeyTruncated
+		}
+		if id == gitCryptFieldEnd {
+			return nil
+		}
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil || int64(size) > int64(r.Len()) {
+			return errGitCryptKeyTruncated
+		}
+		value := make([]byte, size)
+		r.Read(value)
+		if err := set(id, value); err != nil {
+			return err
+		}
+	}
+}
+
+func gitCryptUnknownField(id uint32) error {
+	if id&1 == 1 {
+		return fmt.Errorf("unsupported git-crypt key field %d", id)
+	}
+	return nil
+}
+
+func isGitCryptBlob(blob []byte) bool {
+	return bytes.HasPrefix(blob, gitCryptFileMagic)
+}
+
+// decrypt returns the plaintext of blob, trying every key of the file
+// until the HMAC matches.
+func (k *gitCryptKeyFile) decrypt(blob []byte) ([]byte, error) {
+	if !isGitCryptBlob(blob) || len(blob) < len(gitCryptFileMagic)+gitCryptNonceSize {
+		return nil, errors.New("not encrypted by git-crypt")
+	}
+	nonce := blob[len(gitCryptFileMagic) : len(gitCryptFileMagic)+gitCryptNonceSize]
+	ciphertext := blob[len(gitCryptFileMagic)+gitCryptNonceSize:]
+	plaintext := make([]byte, len(ciphertext))
+	for _, key := range k.Keys {
+		block, err := aes.NewCipher(key.AESKey)
+		if err != nil {
+			return nil, err
+		}
+		// the counter block is the nonce followed by a 32 bit block counter
+		iv := make([]byte, aes.BlockSize)
+		copy(iv, nonce)
+		cipher.NewCTR(block, iv).XORKeyStream(plaintext, ciphertext)
+		mac := hmac.New(sha1.New, key.HMACKey)
+		mac.Write(plaintext)
+		if hmac.Equal(mac.Sum(nil)[:gitCryptNonceSize], nonce) {
+			return plaintext, nil
+		}
+	}
+	return nil, errors.New("git-crypt HMAC mismatch, the file was encrypted with another key or has been tampered with")
+}
+
+// gitCryptSource reads the git-crypt key at path, or the default key of
+// a repository unlocked with git-crypt.
+func gitCryptSource(path string) (*migrationSource, error) {
+	if path == "" {
+		path = GetGitPath() + "/git-crypt/keys/default"
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keyFile, err := parseGitCryptKey(data)
+	if err != nil {
+		return nil, err
+	}
+	driver := "git-crypt"
+	if keyFile.Name != "" {
+		driver += "-" + keyFile.Name
+	}
+	return &migrationSource{
+		Name:        "git-crypt",
+		Driver:      driver,
+		IsEncrypted: isGitCryptBlob,
+		Decrypt:     keyFile.decrypt,
+	}, nil
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// The fixtures follow the formats of git-crypt 0.7 and were written with
+// Python's hmac and 'openssl enc -aes-256-ctr', apart from this code: a key
+// file named "work" with an even unknown header field, key version 1 and
+// then version 0, the legacy form of key version 0, and the same plaintext
+// encrypted with each key.
+const (
+	gitCryptTestKeyFile = "" +
+		"0047495443525950544b4559" +
+		"00000002" +
+		"0000000100000004776f726b" +
+		"000000020000000178" +
+		"00000000" +
+		"000000010000000400000001" +
+		"0000000300000020000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f" +
+		"0000000500000040404142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f606162636465666768696a6b6c6d6e6f707172737475767778797a7b7c7d7e7f" +
+		"00000000" +
+		"000000010000000400000000" +
+		"00000003000000206465666768696a6b6c6d6e6f707172737475767778797a7b7c7d7e7f80818283" +
+		"0000000500000040969798999a9b9c9d9e9fa0a1a2a3a4a5a6a7a8a9aaabacadaeafb0b1b2b3b4b5b6b7b8b9babbbcbdbebfc0c1c2c3c4c5c6c7c8c9cacbcccdcecfd0d1d2d3d4d5" +
+		"00000000"
+	gitCryptTestLegacyKey = "6465666768696a6b6c6d6e6f707172737475767778797a7b7c7d7e7f80818283" +
+		"969798999a9b9c9d9e9fa0a1a2a3a4a5a6a7a8a9aaabacadaeafb0b1b2b3b4b5b6b7b8b9babbbcbdbebfc0c1c2c3c4c5c6c7c8c9cacbcccdcecfd0d1d2d3d4d5"
+	gitCryptTestBlob1 = "00474954435259505400e701e8fa89095936bc41db53531e61ddb9a1d58b54011be843343271b7910a807daead0cbc85f3ffa3224a79de45df343c5743a28a97244c94ef234634c98255"
+	gitCryptTestBlob0 = "0047495443525950540037bcca4e24854f6e1b7f69b4c797dcc6cdebb1e892331a2cb4394d8ca99ba8ee5005c7d647e08ef805f274204fed5e965b261cb326dfa474cf619cce82837307"
+
+	gitCryptTestPlaintext = "hello git-crypt, this spans more than one AES block\n"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestParseGitCryptKey(t *testing.T) {
+	keyFile, err := parseGitCryptKey(decodeHex(t, gitCryptTestKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyFile.Name != "work" {
+		t.Errorf("key name is %q, want work", keyFile.Name)
+	}
+	if len(keyFile.Keys) != 2 || keyFile.Keys[0].Version != 1 || keyFile.Keys[1].Version != 0 {
+		t.Fatalf("parsed keys %+v, want versions 1 and 0", keyFile.Keys)
+	}
+	legacy := decodeHex(t, gitCryptTestLegacyKey)
+	if !bytes.Equal(keyFile.Keys[1].AESKey, legacy[:gitCryptAESKeySize]) || !bytes.Equal(keyFile.Keys[1].HMACKey, legacy[gitCryptAESKeySize:]) {
+		t.Error("key version 0 differs from its legacy form")
+	}
+}
+
+func TestParseGitCryptKeyInvalid(t *testing.T) {
+	keyFile := decodeHex(t, gitCryptTestKeyFile)
+	// an odd field id that is not known must be understood
+	critical := append([]byte{}, keyFile...)
+	critical[len(gitCryptKeyMagic)+4+12+3] = 7
+	for name, data := range map[string][]byte{
+		"truncated":      keyFile[:len(keyFile)-5],
+		"critical field": critical,
+		"no magic":       keyFile[1:],
+		"empty":          nil,
+	} {
+		if _, err := parseGitCryptKey(data); err == nil {
+			t.Errorf("%s key file parsed", name)
+		}
+	}
+}
+
+func TestGitCryptDecrypt(t *testing.T) {
+	keyFile, err := parseGitCryptKey(decodeHex(t, gitCryptTestKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := parseGitCryptKey(decodeHex(t, gitCryptTestLegacyKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name    string
+		keyFile *gitCryptKeyFile
+		blob    string
+		ok      bool
+	}{
+		{"current key", keyFile, gitCryptTestBlob1, true},
+		{"older key", keyFile, gitCryptTestBlob0, true},
+		{"legacy key", legacy, gitCryptTestBlob0, true},
+		{"other key", legacy, gitCryptTestBlob1, false},
+	} {
+		blob := decodeHex(t, test.blob)
+		if !isGitCryptBlob(blob) {
+			t.Fatalf("%s: not seen as a git-crypt blob", test.name)
+		}
+		plaintext, err := test.keyFile.decrypt(blob)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s: decrypted", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if string(plaintext) != gitCryptTestPlaintext {
+			t.Errorf("%s: decrypted %q", test.name, plaintext)
+		}
+	}
+}
+
+func TestGitCryptDecryptTampered(t *testing.T) {
+	keyFile, err := parseGitCryptKey(decodeHex(t, gitCryptTestKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := decodeHex(t, gitCryptTestBlob1)
+	for _, offset := range []int{len(gitCryptFileMagic), len(gitCryptFileMagic) + gitCryptNonceSize, len(blob) - 1} {
+		tampered := append([]byte{}, blob...)
+		tampered[offset] ^= 1
+		if _, err := keyFile.decrypt(tampered); err == nil || !strings.Contains(err.Error(), "HMAC mismatch") {
+			t.Errorf("blob changed at %d returned %v, want an HMAC mismatch", offset, err)
+		}
+	}
+	if _, err := keyFile.decrypt(blob[:len(gitCryptFileMagic)+gitCryptNonceSize-1]); err == nil {
+		t.Error("blob cut in its nonce decrypted")
+	}
+}
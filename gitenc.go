@@ -24,11 +24,57 @@ import (
 	"flag"
 	log "gitenc/log"
 	"os"
+	"strings"
 )
 
 type KeyCommand struct {
-	Key     string
+	Key         string
+	KeyName     string
+	Mode        string
+	Cipher      string
+	Compression string
+	Encoding    string
+	RepoID      string
+
+	Identity    string
+	SSH         string
+	SSHIdentity string
+	KeyFD       int
+	KeyStdin    bool
+
+	Protect   bool
+	Unprotect bool
+
+	Sign   bool
+	NoSign bool
+
+	KDFTime    uint
+	KDFMemory  uint
+	KDFThreads uint
+
+	Force bool
+}
+
+type KeygenCommand struct {
+	Output string
+	Sign   bool
+}
+
+type KeyToolCommand struct {
 	KeyName string
+	Output  string
+	Force   bool
+
+	Shares    uint
+	Threshold uint
+}
+
+type MigrateCommand struct {
+	From       string
+	FromKey    string
+	FromCipher string
+	KeyName    string
+	Key        string
 }
 
 type DoctorCommand struct {
@@ -44,6 +90,45 @@ func main() {
 	KeyCmd := flag.NewFlagSet("init", flag.ExitOnError)
 	KeyCmd.StringVar(&key.Key, "key", "", "Key to use for encryption")
 	KeyCmd.StringVar(&key.KeyName, "keyname", "", "Name of the key to use for encryption")
+	KeyCmd.StringVar(&key.Mode, "mode", "", "Encryption mode: random or deterministic")
+	KeyCmd.StringVar(&key.Cipher, "cipher", "", "Cipher to encrypt with: aes-256-gcm or xchacha20-poly1305")
+	KeyCmd.StringVar(&key.Compression, "compression", "", "Compression to apply before encrypting: gzip, zstd or none")
+	KeyCmd.StringVar(&key.Encoding, "encoding", "", "Encoding of encrypted files: binary or armor for text-only channels")
+	KeyCmd.StringVar(&key.RepoID, "repoid", "", "Repository id to bind encrypted files to")
+	KeyCmd.StringVar(&key.Identity, "identity", "", "Identity file to unwrap the key with")
+	KeyCmd.StringVar(&key.SSH, "ssh", "", "SSH public key or authorized_keys file to wrap the key for")
+	KeyCmd.StringVar(&key.SSHIdentity, "ssh-identity", "", "SSH private key to unwrap the key with")
+	KeyCmd.IntVar(&key.KeyFD, "key-fd", -1, "File descriptor to read the key from, as in GITENC_KEY")
+	KeyCmd.BoolVar(&key.KeyStdin, "key-stdin", false, "Read the key from stdin, as in GITENC_KEY")
+	KeyCmd.BoolVar(&key.Force, "force", false, "Replace a different local key with the one unwrapped by -identity or -ssh-identity")
+	KeyCmd.BoolVar(&key.Protect, "protect", false, "Protect the local key file with a passphrase")
+	KeyCmd.BoolVar(&key.Unprotect, "unprotect", false, "Store the local key file without a passphrase")
+	KeyCmd.BoolVar(&key.Sign, "sign", false, "Sign encrypted files with your signing key")
+	KeyCmd.BoolVar(&key.NoSign, "no-sign", false, "Stop signing encrypted files")
+	KeyCmd.UintVar(&key.KDFTime, "kdf-time", DefaultKDFTime, "Argon2id iterations used to derive the key from -key")
+	KeyCmd.UintVar(&key.KDFMemory, "kdf-memory", DefaultKDFMemory/1024, "Argon2id memory in MiB used to derive the key from -key")
+	KeyCmd.UintVar(&key.KDFThreads, "kdf-threads", DefaultKDFThreads, "Argon2id parallelism used to derive the key from -key")
+
+	keygen := KeygenCommand{}
+	KeygenCmd := flag.NewFlagSet("keygen", flag.ExitOnError)
+	KeygenCmd.StringVar(&keygen.Output, "o", "", "File to write the identity to")
+	KeygenCmd.BoolVar(&keygen.Sign, "sign", false, "Generate a signing key instead of an identity")
+
+	keyTool := KeyToolCommand{}
+	KeyToolCmd := flag.NewFlagSet("key", flag.ExitOnError)
+	KeyToolCmd.StringVar(&keyTool.KeyName, "keyname", "", "Name of the key")
+	KeyToolCmd.StringVar(&keyTool.Output, "o", "", "File to write to instead of stdout")
+	KeyToolCmd.BoolVar(&keyTool.Force, "force", false, "Replace a different existing key")
+	KeyToolCmd.UintVar(&keyTool.Shares, "n", 5, "Number of shares to split the key into")
+	KeyToolCmd.UintVar(&keyTool.Threshold, "k", 3, "Number of shares needed to recover the key")
+
+	migrate := MigrateCommand{}
+	MigrateCmd := flag.NewFlagSet("migrate", flag.ExitOnError)
+	MigrateCmd.StringVar(&migrate.From, "from", "", "Tool to migrate from: git-crypt or transcrypt")
+	MigrateCmd.StringVar(&migrate.FromKey, "from-key", "", "git-crypt key file, .git/git-crypt/keys/default by default, or transcrypt password, git config transcrypt.password by default")
+	MigrateCmd.StringVar(&migrate.FromCipher, "from-cipher", "", "transcrypt cipher, git config transcrypt.cipher or aes-256-cbc by default")
+	MigrateCmd.StringVar(&migrate.KeyName, "keyname", "", "Name of the gitenc key to encrypt with")
+	MigrateCmd.StringVar(&migrate.Key, "key", "", "Key to derive a new gitenc key from, a random key otherwise")
 
 	doctor := DoctorCommand{}
 	DoctorCmd := flag.NewFlagSet("doctor", flag.ExitOnError)
@@ -70,15 +155,66 @@ func main() {
 	case "unlock":
 		KeyCmd.Parse(os.Args[2:])
 		Unlock(key)
+	case "keygen":
+		KeygenCmd.Parse(os.Args[2:])
+		Keygen(keygen)
+	case "add-user":
+		KeyCmd.Parse(os.Args[2:])
+		AddUser(key, KeyCmd.Arg(0))
+	case "remove-user":
+		KeyCmd.Parse(os.Args[2:])
+		RemoveUser(key, KeyCmd.Arg(0))
+	case "trust":
+		KeyCmd.Parse(os.Args[2:])
+		name := ""
+		if KeyCmd.NArg() > 1 {
+			name = strings.Join(KeyCmd.Args()[1:], " ")
+		}
+		Trust(KeyCmd.Arg(0), name)
+	case "verify-signatures":
+		KeyCmd.Parse(os.Args[2:])
+		VerifySignatures(KeyCmd.Arg(0))
+	case "rotate":
+		KeyCmd.Parse(os.Args[2:])
+		Rotate(key)
+	case "key":
+		if len(os.Args) < 3 {
+			log.Error("Not enough arguments")
+			showHelp()
+			return
+		}
+		KeyToolCmd.Parse(os.Args[3:])
+		switch os.Args[2] {
+		case "export":
+			ExportKey(keyTool)
+		case "import":
+			ImportKey(keyTool, KeyToolCmd.Arg(0))
+		case "split":
+			SplitKey(keyTool)
+		case "combine":
+			CombineKey(keyTool, KeyToolCmd.Args())
+		case "backup":
+			BackupKey(keyTool)
+		case "restore":
+			RestoreKey(keyTool, KeyToolCmd.Args())
+		default:
+			log.Warning("Unknown command: key " + os.Args[2] + ". Try 'gitenc help' for more information.")
+		}
+	case "migrate":
+		MigrateCmd.Parse(os.Args[2:])
+		Migrate(migrate)
 	case "doctor":
 		DoctorCmd.Parse(os.Args[2:])
 		Doctor(doctor)
 	case "smudge":
 		KeyCmd.Parse(os.Args[2:])
-		Smudge(key)
+		Smudge(key, KeyCmd.Arg(0))
 	case "clean":
 		KeyCmd.Parse(os.Args[2:])
-		Clean(key)
+		Clean(key, KeyCmd.Arg(0))
+	case "filter-process":
+		KeyCmd.Parse(os.Args[2:])
+		FilterProcess(key)
 	case "diff":
 		KeyCmd.Parse(os.Args[2:])
 		Diff(key, os.Args[len(os.Args)-1])
@@ -96,9 +232,22 @@ func showHelp() {
 	log.Info("Usage: gitenc <command> [options]")
 	log.Info("Commands:")
 	log.Log("init - Initialize gitenc in the current repository")
-	log.Log("set - Set the key to use for encryption")
+	log.Log("set - Set a key, or add one for files with filter=gitenc-<keyname> diff=gitenc-<keyname>")
 	log.Log("lock - Lock the repository")
-	log.Log("unlock - Unlock the repository")
+	log.Log("unlock - Unlock the repository, with the key in GITENC_KEY or GITENC_KEY_FILE, or read with -key-fd or -key-stdin")
+	log.Log("keygen - Generate an identity to receive keys with, or a signing key with -sign")
+	log.Log("add-user - Wrap the key for the public key of another user, their SSH keys with -ssh, or a KMS key as vault-transit:<mount>/<key>")
+	log.Log("remove-user - Remove a user, or their SSH keys with -ssh, and replace the key they held")
+	log.Log("trust - Trust the signatures of a signing key, your own by default")
+	log.Log("verify-signatures - Check who signed the encrypted files")
+	log.Log("rotate - Replace the key and re-encrypt all files with it")
+	log.Log("key export - Print the key as a text block to store or share")
+	log.Log("key import - Install a key printed by 'gitenc key export'")
+	log.Log("key split - Split the key into shares, some of which recover it")
+	log.Log("key combine - Recover the key from enough shares")
+	log.Log("key backup - Print the key as words for a paper backup")
+	log.Log("key restore - Recover the key from the words of a backup")
+	log.Log("migrate - Take over the files encrypted by git-crypt or transcrypt")
 	log.Log("doctor - Check the repository for problems")
 	log.Log("version - Print the version of gitenc")
 	log.Log("help - Print this help message")
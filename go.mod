@@ -1,3 +1,12 @@
 module gitenc
 
 go 1.19
+
+require (
+	github.com/klauspost/compress v1.17.4
+	github.com/tyler-smith/go-bip39 v1.1.0
+	golang.org/x/crypto v0.14.0
+	golang.org/x/term v0.14.0
+)
+
+require golang.org/x/sys v0.14.0 // indirect
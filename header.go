@@ -0,0 +1,386 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Every encrypted blob starts with a header. Version 2 has a fixed layout,
+// all integers are big-endian:
+//
+//	offset  size  field
+//	0       4     magic "\0MR\0"
+//	4       1     version (2)
+//	5       1     flags
+//	6       2     length n of the record section
+//	8       n     records, each: type (1), length (2), value
+//
+// Record types below 0x80 must be understood by the reader, types from 0x80
+// up may be skipped. The encrypted payload follows the record section.
+//
+// Version 1 headers are the memory image of the old HEADER struct on
+// little-endian hosts: magic, version, MD5 key hash (16), MD5 file hash (16),
+// mode (1), padding (3) and a uint64 payload size, 48 bytes in total.
+
+var Magic = [4]byte{0, 'M', 'R', 0}
+
+const (
+	HeaderV1Size  = 48
+	HeaderV2Fixed = 8
+	MaxHeaderSize = HeaderV2Fixed + 0xffff
+)
+
+const (
+	FlagDeterministic byte = 1 << iota
+	// FlagStream marks payloads in the chunked format of stream.go
+	FlagStream
+	// FlagBound marks payloads sealed with the header as associated data,
+	// which ties them to the path and repository id recorded in it
+	FlagBound
+	// FlagSigned marks blobs followed by an Ed25519 signature of the
+	// header and payload, made with the key in the signer record
+	FlagSigned
+	// FlagSyntheticHeader marks deterministic blobs whose salt covers the
+	// header before the plaintext, so that blobs with different headers,
+	// and thus different associated data, never share a nonce
+	FlagSyntheticHeader
+)
+
+const (
+	RecordCipher    byte = 0x01
+	RecordKDF       byte = 0x02
+	RecordKeyName   byte = 0x03
+	RecordKeyHash   byte = 0x04
+	RecordFileHash  byte = 0x05
+	RecordKDFParams byte = 0x06
+	RecordKeyID     byte = 0x07
+	RecordCompress  byte = 0x08
+	RecordPath      byte = 0x09
+	RecordRepoID    byte = 0x0a
+	RecordSigner    byte = 0x0b
+)
+
+const (
+	CipherAES256GCM         byte = 1
+	CipherXChaCha20Poly1305 byte = 2
+)
+
+const (
+	CompressNone byte = iota + 1
+	CompressGzip
+	CompressZstd
+)
+
+const (
+	KDFNone byte = iota
+	KDFLegacyMD5
+	KDFArgon2id
+)
+
+var ErrNotEncrypted = errors.New("data is not encrypted by gitenc")
+
+type Record struct {
+	Type  byte
+	Value []byte
+}
+
+type Header struct {
+	Version   byte
+	Flags     byte
+	Cipher    byte
+	KDF       byte
+	KeyName   string
+	KeyID     []byte
+	KDFParams []byte
+	// Compress is zero for blobs written before it was recorded.
+	Compress byte
+	Path     string
+	RepoID   string
+	Signer   []byte
+	// KeyHash and FileHash are the unkeyed MD5 sums written by older
+	// versions. They are still checked when present but never written.
+	KeyHash  []byte
+	FileHash []byte
+	// Size is only present in version 1 headers.
+	Size uint64
+	// Unknown keeps optional records this version does not understand.
+	Unknown []Record
+
+	raw []byte
+}
+
+func (h *Header) Streamed() bool {
+	return h.Flags&FlagStream != 0
+}
+
+func (h *Header) Bound() bool {
+	return h.Flags&FlagBound != 0
+}
+
+func (h *Header) Signed() bool {
+	return h.Flags&FlagSigned != 0
+}
+
+// AdditionalData returns what bound payloads are authenticated with: the
+// header exactly as it was read or written.
+func (h *Header) AdditionalData() []byte {
+	if !h.Bound() {
+		return nil
+	}
+	return h.Raw()
+}
+
+// Raw returns the header exactly as it was read or written.
+func (h *Header) Raw() []byte {
+	if h.raw == nil {
+		h.raw = h.Bytes()
+	}
+	return h.raw
+}
+
+func (h *Header) Mode() byte {
+	if h.Flags&FlagDeterministic != 0 {
+		return ModeDeterministic
+	}
+	return ModeRandom
+}
+
+// ParseHeader decodes the header at the start of data and returns it along
+// with the encrypted payload that follows it.
+func ParseHeader(data []byte) (*Header, []byte, error) {
+	if len(data) < HeaderV2Fixed || !bytes.Equal(data[:4], Magic[:]) {
+		return nil, nil, ErrNotEncrypted
+	}
+	switch data[4] {
+	case 1:
+		return parseHeaderV1(data)
+	case 2:
+		return parseHeaderV2(data)
+	}
+	return nil, nil, fmt.Errorf("unsupported header version %d", data[4])
+}
+
+// PeekHeader decodes the header at the start of r, binary or armored,
+// without consuming it and returns its size, so the caller can either skip
+// it with OpenPayload or pass the blob on untouched. r must be able to
+// buffer MaxPeekSize bytes.
+func PeekHeader(r *bufio.Reader) (*Header, int, error) {
+	peek := func(n int) []byte {
+		data, _ := r.Peek(n)
+		return data
+	}
+	if isArmoredBlob(peek(len(armorMessageBegin))) {
+		decoded := peekArmored(r)
+		peek = func(n int) []byte {
+			if n > len(decoded) {
+				n = len(decoded)
+			}
+			return decoded[:n]
+		}
+	}
+	fixed := peek(HeaderV2Fixed)
+	if len(fixed) < HeaderV2Fixed || !bytes.Equal(fixed[:4], Magic[:]) {
+		return nil, 0, ErrNotEncrypted
+	}
+	size := HeaderV1Size
+	if fixed[4] == 2 {
+		size = HeaderV2Fixed + int(binary.BigEndian.Uint16(fixed[6:8]))
+	}
+	data := peek(size)
+	header, payload, err := ParseHeader(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return header, len(data) - len(payload), nil
+}
+
+// OpenPayload consumes the header of size bytes that PeekHeader found at
+// the start of r and returns the payload that follows it.
+func (h *Header) OpenPayload(r *bufio.Reader, size int) (io.Reader, error) {
+	var in io.Reader = r
+	if begin, _ := r.Peek(len(armorMessageBegin)); isArmoredBlob(begin) {
+		armored, err := newArmorReader(r)
+		if err != nil {
+			return nil, err
+		}
+		in = armored
+		if _, err := io.CopyN(io.Discard, in, int64(size)); err != nil {
+			return nil, err
+		}
+	} else if _, err := r.Discard(size); err != nil {
+		return nil, err
+	}
+	return h.Payload(in), nil
+}
+
+// Payload returns the part of r that belongs to the payload of the blob.
+// The payload of a signed blob reports an error instead of io.EOF when the
+// signature at its end does not match.
+func (h *Header) Payload(r io.Reader) io.Reader {
+	if h.Version == 1 {
+		return io.LimitReader(r, int64(h.Size))
+	}
+	if h.Signed() {
+		return newSignatureReader(r, h)
+	}
+	return r
+}
+
+func parseHeaderV1(data []byte) (*Header, []byte, error) {
+	if len(data) < HeaderV1Size {
+		return nil, nil, ErrNotEncrypted
+	}
+	h := &Header{
+		Version:  1,
+		Cipher:   CipherAES256GCM,
+		KDF:      KDFLegacyMD5,
+		KeyHash:  clone(data[5:21]),
+		FileHash: clone(data[21:37]),
+		Size:     binary.LittleEndian.Uint64(data[40:48]),
+	}
+	if data[37] == ModeDeterministic {
+		h.Flags |= FlagDeterministic
+	}
+	payload := data[HeaderV1Size:]
+	if h.Size <= uint64(len(payload)) {
+		payload = payload[:h.Size]
+	}
+	return h, payload, nil
+}
+
+func parseHeaderV2(data []byte) (*Header, []byte, error) {
+	h := &Header{Version: 2, Flags: data[5]}
+	end := HeaderV2Fixed + int(binary.BigEndian.Uint16(data[6:8]))
+	if len(data) < end {
+		return nil, nil, errors.New("truncated header")
+	}
+	records := data[HeaderV2Fixed:end]
+	for len(records) > 0 {
+		if len(records) < 3 {
+			return nil, nil, errors.New("truncated header record")
+		}
+		typ, size := records[0], int(binary.BigEndian.Uint16(records[1:3]))
+		if len(records) < 3+size {
+			return nil, nil, errors.New("truncated header record")
+		}
+		value := clone(records[3 : 3+size])
+		records = records[3+size:]
+		if err := h.setRecord(typ, value); err != nil {
+			return nil, nil, err
+		}
+	}
+	h.raw = clone(data[:end])
+	return h, data[end:], nil
+}
+
+func clone(b []byte) []byte {
+	return append([]byte{}, b...)
+}
+
+func (h *Header) setRecord(typ byte, value []byte) error {
+	switch typ {
+	case RecordCipher, RecordKDF, RecordCompress:
+		if len(value) != 1 {
+			return fmt.Errorf("invalid header record %#x", typ)
+		}
+		switch typ {
+		case RecordCipher:
+			h.Cipher = value[0]
+		case RecordKDF:
+			h.KDF = value[0]
+		default:
+			h.Compress = value[0]
+		}
+	case RecordKeyName:
+		h.KeyName = string(value)
+	case RecordKeyHash:
+		h.KeyHash = value
+	case RecordFileHash:
+		h.FileHash = value
+	case RecordKDFParams:
+		h.KDFParams = value
+	case RecordKeyID:
+		h.KeyID = value
+	case RecordPath:
+		h.Path = string(value)
+	case RecordRepoID:
+		h.RepoID = string(value)
+	case RecordSigner:
+		h.Signer = value
+	default:
+		if typ < 0x80 {
+			return fmt.Errorf("unsupported header record %#x", typ)
+		}
+		h.Unknown = append(h.Unknown, Record{typ, value})
+	}
+	return nil
+}
+
+func (h *Header) records() []Record {
+	records := []Record{
+		{RecordCipher, []byte{h.Cipher}},
+		{RecordKDF, []byte{h.KDF}},
+	}
+	if h.KeyName != "" {
+		records = append(records, Record{RecordKeyName, []byte(h.KeyName)})
+	}
+	if h.KeyID != nil {
+		records = append(records, Record{RecordKeyID, h.KeyID})
+	}
+	if h.KDFParams != nil {
+		records = append(records, Record{RecordKDFParams, h.KDFParams})
+	}
+	if h.Compress != 0 {
+		records = append(records, Record{RecordCompress, []byte{h.Compress}})
+	}
+	if h.Path != "" {
+		records = append(records, Record{RecordPath, []byte(h.Path)})
+	}
+	if h.RepoID != "" {
+		records = append(records, Record{RecordRepoID, []byte(h.RepoID)})
+	}
+	if h.Signer != nil {
+		records = append(records, Record{RecordSigner, h.Signer})
+	}
+	return append(records, h.Unknown...)
+}
+
+// Bytes encodes the header in the version 2 layout.
+func (h *Header) Bytes() []byte {
+	var body bytes.Buffer
+	for _, r := range h.records() {
+		body.WriteByte(r.Type)
+		binary.Write(&body, binary.BigEndian, uint16(len(r.Value)))
+		body.Write(r.Value)
+	}
+	out := make([]byte, HeaderV2Fixed, HeaderV2Fixed+body.Len())
+	copy(out, Magic[:])
+	out[4] = 2
+	out[5] = h.Flags
+	binary.BigEndian.PutUint16(out[6:8], uint16(body.Len()))
+	return append(out, body.Bytes()...)
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// KDFParams describes how a key was derived from a password. It is stored
+// next to the key file and in the header of every blob, so that a clone
+// holding the same password derives the same key.
+type KDFParams struct {
+	KDF     byte   `json:"kdf"`
+	Salt    []byte `json:"salt,omitempty"`
+	Time    uint32 `json:"time,omitempty"`
+	Memory  uint32 `json:"memory,omitempty"`
+	Threads uint8  `json:"threads,omitempty"`
+}
+
+const (
+	DefaultKDFTime    = 3
+	DefaultKDFMemory  = 64 * 1024
+	DefaultKDFThreads = 4
+	KDFSaltSize       = 16
+)
+
+func NewKDFParams(time, memory uint32, threads uint8) (*KDFParams, error) {
+	if time == 0 || memory < 8*uint32(threads) || threads == 0 {
+		return nil, fmt.Errorf("invalid argon2id parameters: time=%d memory=%dKiB threads=%d", time, memory, threads)
+	}
+	salt := make([]byte, KDFSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return &KDFParams{
+		KDF:     KDFArgon2id,
+		Salt:    salt,
+		Time:    time,
+		Memory:  memory,
+		Threads: threads,
+	}, nil
+}
+
+// DeriveKey turns a password into a 32 byte key.
+func DeriveKey(password string, params *KDFParams) ([]byte, error) {
+	switch params.KDF {
+	case KDFArgon2id:
+		return argon2.IDKey([]byte(password), params.Salt, params.Time, params.Memory, params.Threads, 32), nil
+	case KDFLegacyMD5:
+		return GenerateKey(password), nil
+	}
+	return nil, fmt.Errorf("cannot derive a key with kdf %d", params.KDF)
+}
+
+// Bytes encodes the parameters for the blob header: time (4), memory (4),
+// threads (1) followed by the salt.
+func (p *KDFParams) Bytes() []byte {
+	out := make([]byte, 9, 9+len(p.Salt))
+	binary.BigEndian.PutUint32(out[0:4], p.Time)
+	binary.BigEndian.PutUint32(out[4:8], p.Memory)
+	out[8] = p.Threads
+	return append(out, p.Salt...)
+}
+
+func ParseKDFParams(kdf byte, data []byte) (*KDFParams, error) {
+	if len(data) < 9 {
+		return nil, errors.New("invalid kdf parameters")
+	}
+	return &KDFParams{
+		KDF:     kdf,
+		Time:    binary.BigEndian.Uint32(data[0:4]),
+		Memory:  binary.BigEndian.Uint32(data[4:8]),
+		Threads: data[8],
+		Salt:    append([]byte(nil), data[9:]...),
+	}, nil
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	log "gitenc/log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// git config gitenc.keyHelper names a program that keeps keys somewhere
+// else, such as a password manager, the way git's credential helpers keep
+// passwords. It is run by the shell with the action as its argument and is
+// given key=value lines up to an empty line on stdin:
+//
+//	keyname=<name of the key>
+//	repoid=<repository id, when set>
+//	key=<hex key>        store only
+//	keyring=<hex key>    store only, once per decrypt-only key
+//
+// "get" answers with the key and keyring lines, in hex or base64, or with
+// nothing or a failure when the helper does not have the key. "store" is
+// run whenever gitenc writes a new key and "erase" when the key the helper
+// gave matches none of the encrypted files. The helper is only asked when there is no
+// key file, once per gitenc process, and what it gives is never written to
+// .git/gitenc/keys.
+
+type helperAnswer struct {
+	keys [][]byte
+	err  error
+}
+
+var (
+	helperMu      sync.Mutex
+	helperAnswers = map[string]*helperAnswer{}
+)
+
+func keyHelper() string {
+	return GetGitConfig("gitenc.keyHelper")
+}
+
+func helperRequest(keyName string) []string {
+	request := []string{"keyname=" + keyName}
+	if id := repoID(); id != "" {
+		request = append(request, "repoid="+id)
+	}
+	return request
+}
+
+// runKeyHelper runs helper for action and returns what it printed. Like
+// git, a helper starting with '!' is a shell snippet, which is how any
+// other helper is run as well.
+func runKeyHelper(helper, action string, request []string) (string, error) {
+	helper = strings.TrimPrefix(helper, "!")
+	cmd := exec.Command("sh", "-c", helper+` "$@"`, helper, action)
+	cmd.Stdin = strings.NewReader(strings.Join(request, "\n") + "\n\n")
+	// stdout is the answer, the helper may still talk to the user
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("key helper '%s %s' failed: %v", helper, action, err)
+	}
+	return string(out), nil
+}
+
+// helperKeys returns the current key and keyring of keyName the key helper
+// has, or nil when there is no helper or it does not have the key.
+func helperKeys(keyName string) ([][]byte, error) {
+	helper := keyHelper()
+	if helper == "" {
+		return nil, nil
+	}
+	helperMu.Lock()
+	defer helperMu.Unlock()
+	answer, ok := helperAnswers[keyName]
+	if !ok {
+		answer = &helperAnswer{}
+		answer.keys, answer.err = getHelperKeys(helper, keyName)
+		helperAnswers[keyName] = answer
+	}
+	return append([][]byte(nil), answer.keys...), answer.err
+}
+
+func getHelperKeys(helper, keyName string) ([][]byte, error) {
+	out, err := runKeyHelper(helper, "get", helperRequest(keyName))
+	if err != nil {
+		// like git, a failing helper just has no key
+		log.Warning(err)
+		return nil, nil
+	}
+	var key []byte
+	var keyring [][]byte
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok || (name != "key" && name != "keyring") {
+			continue
+		}
+		parsed, err := parseRawKey(value)
+		if err != nil {
+			return nil, fmt.Errorf("key helper gave an invalid %s: %v", name, err)
+		}
+		if name == "key" {
+			key = parsed
+		} else {
+			keyring = append(keyring, parsed)
+		}
+	}
+	if key == nil {
+		return nil, nil
+	}
+	return append([][]byte{key}, keyring...), nil
+}
+
+// storeHelperKey hands a new key of keyName and its keyring to the key
+// helper.
+func storeHelperKey(keyName string, key []byte, keyring [][]byte) {
+	helper := keyHelper()
+	if helper == "" {
+		return
+	}
+	request := append(helperRequest(keyName), "key="+hex.EncodeToString(key))
+	for _, old := range keyring {
+		request = append(request, "keyring="+hex.EncodeToString(old))
+	}
+	if _, err := runKeyHelper(helper, "store", request); err != nil {
+		log.Warning("Error storing key", keyName, "in the key helper:", err)
+	}
+}
+
+// eraseHelperKey tells the key helper to forget the key of keyName.
+func eraseHelperKey(keyName string) {
+	helper := keyHelper()
+	if helper == "" {
+		return
+	}
+	helperMu.Lock()
+	delete(helperAnswers, keyName)
+	helperMu.Unlock()
+	if _, err := runKeyHelper(helper, "erase", helperRequest(keyName)); err != nil {
+		log.Warning("Error erasing key", keyName, "from the key helper:", err)
+		return
+	}
+	log.Warning("Key", keyName, "was erased from the key helper")
+}
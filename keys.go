@@ -0,0 +1,311 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "gitenc/log"
+	"os"
+)
+
+// Keys live in .git/gitenc/keys/: <name> holds the key, <name>.json the
+// parameters it was derived with and <name>.old/ is a keyring of previous
+// keys, named by key id, that are only used to decrypt blobs written before
+// the key was replaced. The key files are either raw or protected by a
+// passphrase; new keys are written the same way as the current key.
+
+func writeKey(keyPath, keyName string, key []byte, params *KDFParams) error {
+	if err := os.MkdirAll(keyPath, 0700); err != nil {
+		return err
+	}
+	protection, err := protectionOf(keyPath + keyName)
+	if err != nil {
+		return err
+	}
+	meta, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath+keyName+".json", meta, 0600); err != nil {
+		return err
+	}
+	if err := writeKeyFile(keyPath+keyName, key, protection); err != nil {
+		return err
+	}
+	storeHelperKey(keyName, key, loadOldKeys(keyPath, keyName))
+	return nil
+}
+
+// readKeyParams returns the parameters of a key. Keys written before the
+// metadata file existed were always derived with MD5.
+func readKeyParams(keyPath, keyName string) (*KDFParams, error) {
+	if keys, err := sourceKeys(keyName); err != nil {
+		return nil, err
+	} else if keys != nil {
+		return sourceKeyParams(keyName), nil
+	}
+	if !fileExists(keyPath + keyName) {
+		if keys, err := externalKeys(keyName); err != nil {
+			return nil, err
+		} else if keys != nil {
+			return blobKeyParams(keyName, keys[0]), nil
+		}
+	}
+	meta, err := os.ReadFile(keyPath + keyName + ".json")
+	if os.IsNotExist(err) {
+		return &KDFParams{KDF: KDFLegacyMD5}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	params := &KDFParams{}
+	if err := json.Unmarshal(meta, params); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+func saveOldKey(keyPath, keyName string, key []byte) error {
+	dir := keyPath + keyName + ".old/"
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	protection, err := protectionOf(keyPath + keyName)
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(dir+hex.EncodeToString(KeyID(key)), key, protection)
+}
+
+func loadOldKeys(keyPath, keyName string) [][]byte {
+	dir := keyPath + keyName + ".old/"
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	keys := make([][]byte, 0, len(entries))
+	for _, entry := range entries {
+		if key, err := readKeyFile(dir + entry.Name()); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// loadKeys returns the current key followed by the decrypt-only keys. A
+// key given in the environment replaces the key file.
+func loadKeys(keyPath, keyName string) ([][]byte, error) {
+	keys, err := sourceKeys(keyName)
+	if err != nil {
+		return nil, err
+	}
+	if keys == nil {
+		if keys, err = fileKeys(keyPath, keyName); err != nil {
+			return nil, err
+		}
+	}
+	return append(keys, loadOldKeys(keyPath, keyName)...), nil
+}
+
+// fileKeys reads the key file of keyName, or asks the key helper when there
+// is none.
+func fileKeys(keyPath, keyName string) ([][]byte, error) {
+	key, err := readKeyFile(keyPath + keyName)
+	if err == nil {
+		return [][]byte{key}, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if keys, externalErr := externalKeys(keyName); keys != nil || externalErr != nil {
+		return keys, externalErr
+	}
+	return nil, err
+}
+
+// externalKeys returns the keys of keyName kept outside of the repository,
+// by the key helper or a KMS, or nil when there are none.
+func externalKeys(keyName string) ([][]byte, error) {
+	keys, err := helperKeys(keyName)
+	if keys != nil || err != nil {
+		return keys, err
+	}
+	return transitKeys(keyName)
+}
+
+// haveKey reports whether keyName has a key, in its key file, the
+// environment or the key helper, so that it is not replaced by a new one.
+func haveKey(keyPath, keyName string) bool {
+	if fileExists(keyPath + keyName) {
+		return true
+	}
+	keys, err := sourceKeys(keyName)
+	if keys == nil && err == nil {
+		keys, err = externalKeys(keyName)
+	}
+	return keys != nil || err != nil
+}
+
+// unlockKeys is loadKeys for interactive commands, it asks for the
+// passphrase of a protected key that is not unlocked yet.
+func unlockKeys(keyPath, keyName string) ([][]byte, error) {
+	keys, err := sourceKeys(keyName)
+	if err != nil {
+		return nil, err
+	}
+	if keys == nil {
+		if _, err := protectionOf(keyPath + keyName); err != nil {
+			return nil, err
+		}
+	}
+	return loadKeys(keyPath, keyName)
+}
+
+// findKey picks the key that was used to encrypt the blob.
+func findKey(header *Header, keys [][]byte) ([]byte, error) {
+	for _, key := range keys {
+		if header.KeyID != nil {
+			if hmac.Equal(header.KeyID, KeyID(key)) {
+				return key, nil
+			}
+		} else if khash := Hash(key); bytes.Equal(header.KeyHash, khash[:]) {
+			return key, nil
+		}
+	}
+	return nil, errKeyMismatch
+}
+
+// verifyKeys checks recovered keys against the key ids in the headers of
+// the encrypted blobs of keyName in the index and returns the header of the
+// first blob they match. It fails when none of the blobs can be decrypted
+// with them.
+func verifyKeys(keyName string, keys [][]byte) (*Header, error) {
+	var first *Header
+	matched, total := 0, 0
+	for _, file := range getEncryptFiles(keyName) {
+		header, err := blobHeader(":" + file)
+		if err != nil || (header.KeyName != "" && header.KeyName != keyName) {
+			continue
+		}
+		total++
+		if _, err := findKey(header, keys); err == nil {
+			matched++
+			if first == nil {
+				first = header
+			}
+		}
+	}
+	if total == 0 {
+		log.Warning("No encrypted files to verify the key against")
+	} else if matched == 0 {
+		return nil, fmt.Errorf("the key matches none of the %d encrypted files", total)
+	} else if matched < total {
+		log.Warning(total-matched, "of", total, "encrypted files use a key that was not recovered")
+	} else {
+		log.Info("The key matches all", total, "encrypted files")
+	}
+	return first, nil
+}
+
+// repoKDFParams looks through the encrypted blobs in the index for the
+// parameters keyName was derived with, and reports whether any blob still
+// uses a legacy MD5 key.
+func repoKDFParams(keyName string) (*KDFParams, bool) {
+	var params *KDFParams
+	legacy := false
+	for _, file := range getEncryptFiles(keyName) {
+		header, err := blobHeader(":" + file)
+		if err != nil || (header.KeyName != "" && header.KeyName != keyName) {
+			continue
+		}
+		if header.KDF == KDFLegacyMD5 {
+			legacy = true
+		} else if header.KDF == KDFArgon2id && params == nil {
+			params, _ = ParseKDFParams(header.KDF, header.KDFParams)
+		}
+		if params != nil && legacy {
+			break
+		}
+	}
+	return params, legacy
+}
+
+// newKey creates the key for keyName. Without a password the key is random,
+// otherwise it is derived with argon2id, reusing the parameters recorded in
+// the repository so that every clone ends up with the same key. When the
+// repository still holds MD5-derived blobs, the legacy key is returned as
+// well so they stay readable.
+func newKey(command KeyCommand, keyName string) ([]byte, *KDFParams, [][]byte, error) {
+	if command.Key == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, nil, nil, err
+		}
+		return key, &KDFParams{KDF: KDFNone}, nil, nil
+	}
+	params, legacy := repoKDFParams(keyName)
+	if params == nil {
+		var err error
+		params, err = NewKDFParams(uint32(command.KDFTime), uint32(command.KDFMemory)*1024, uint8(command.KDFThreads))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	key, err := DeriveKey(command.Key, params)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var old [][]byte
+	if legacy {
+		old = append(old, GenerateKey(command.Key))
+	}
+	return key, params, old, nil
+}
+
+// protectKeys writes the current key and the keyring of keyName again,
+// sealed under protection, or raw when protection is nil.
+func protectKeys(keyPath, keyName string, protection *keyProtection) error {
+	if _, err := protectionOf(keyPath + keyName); err != nil {
+		return err
+	}
+	key, err := readKeyFile(keyPath + keyName)
+	if err != nil {
+		return err
+	}
+	dir := keyPath + keyName + ".old/"
+	old := loadOldKeys(keyPath, keyName)
+	forgetProtection(keyPath + keyName)
+	for _, oldKey := range old {
+		if err := writeKeyFile(dir+hex.EncodeToString(KeyID(oldKey)), oldKey, protection); err != nil {
+			return err
+		}
+	}
+	if err := writeKeyFile(keyPath+keyName, key, protection); err != nil {
+		return err
+	}
+	if protection != nil {
+		return protection.cache()
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// CI jobs and other non-interactive uses can give the key without a key
+// file: GITENC_KEY holds the key and GITENC_KEY_FILE names a file holding
+// it. 'gitenc unlock -key-fd/-key-stdin' reads the key once and hands it to
+// the filters git runs in GITENC_KEY. The key is either what 'gitenc key
+// export' prints, which names the key and carries its keyring, or the raw
+// 32 byte key in hex or base64, which is taken as the primary key. Such a
+// key takes precedence over the key file and is never written to
+// .git/gitenc/keys.
+
+const (
+	keyEnv     = "GITENC_KEY"
+	keyFileEnv = "GITENC_KEY_FILE"
+)
+
+var (
+	keySourceOnce sync.Once
+	keySource     *ExportedKey
+	keySourceErr  error
+)
+
+// readKeySource returns the key given in the environment, or nil.
+func readKeySource() (*ExportedKey, error) {
+	keySourceOnce.Do(func() {
+		name, value := keyEnv, os.Getenv(keyEnv)
+		if value == "" {
+			name = os.Getenv(keyFileEnv)
+			if name == "" {
+				return
+			}
+			data, err := os.ReadFile(name)
+			if err != nil {
+				keySourceErr = fmt.Errorf("%s: %v", keyFileEnv, err)
+				return
+			}
+			value = string(data)
+		}
+		if keySource, keySourceErr = parseKeySource(value); keySourceErr != nil {
+			keySourceErr = fmt.Errorf("%s: %v", name, keySourceErr)
+		}
+	})
+	return keySource, keySourceErr
+}
+
+// parseKeySource reads an exported key or a raw key. A raw key has neither
+// a name nor parameters.
+func parseKeySource(value string) (*ExportedKey, error) {
+	if strings.Contains(value, "-----BEGIN "+armorKey+"-----") {
+		return ParseArmoredKey(value)
+	}
+	key, err := parseRawKey(value)
+	if err != nil {
+		return nil, errors.New("not an exported key nor a 32 byte key in hex or base64")
+	}
+	return &ExportedKey{Keys: [][]byte{key}}, nil
+}
+
+// parseRawKey reads a 32 byte key in hex or base64.
+func parseRawKey(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	key, err := hex.DecodeString(value)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(value)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("not a 32 byte key in hex or base64")
+	}
+	return key, nil
+}
+
+// sourceKeys returns the current key and keyring of keyName given in the
+// environment, or nil when the environment has no key for it.
+func sourceKeys(keyName string) ([][]byte, error) {
+	source, err := readKeySource()
+	if source == nil || err != nil {
+		return nil, err
+	}
+	name := source.Name
+	if name == "" {
+		name = primaryKeyName()
+	}
+	if name != keyName {
+		return nil, nil
+	}
+	return append([][]byte(nil), source.Keys...), nil
+}
+
+// sourceKeyParams returns the parameters of the key given in the
+// environment, those of a raw key are looked up in the blobs.
+func sourceKeyParams(keyName string) *KDFParams {
+	if keySource.Params == nil {
+		keySource.Params = blobKeyParams(keyName, keySource.Keys[0])
+	}
+	return keySource.Params
+}
+
+// blobKeyParams returns the parameters recorded in the first blob of
+// keyName encrypted with key. A key that encrypted nothing yet is taken as
+// random.
+func blobKeyParams(keyName string, key []byte) *KDFParams {
+	keyID := KeyID(key)
+	for _, file := range getEncryptFiles(keyName) {
+		header, err := blobHeader(":" + file)
+		if err != nil || !bytes.Equal(header.KeyID, keyID) {
+			continue
+		}
+		if header.KDF != KDFArgon2id {
+			return &KDFParams{KDF: header.KDF}
+		}
+		if params, err := ParseKDFParams(header.KDF, header.KDFParams); err == nil {
+			return params
+		}
+	}
+	return &KDFParams{KDF: KDFNone}
+}
+
+// readKeyInput reads the key unlock was told to take from a file
+// descriptor or stdin, which can only be read once, and passes it on in
+// GITENC_KEY. It reports whether a key was read.
+func readKeyInput(command KeyCommand) (bool, error) {
+	fd := command.KeyFD
+	if command.KeyStdin {
+		fd = 0
+	}
+	if fd < 0 {
+		return false, nil
+	}
+	f := os.Stdin
+	if fd != 0 {
+		f = os.NewFile(uintptr(fd), "key input")
+		defer f.Close()
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return false, err
+	}
+	if _, err := parseKeySource(string(data)); err != nil {
+		return false, err
+	}
+	return true, os.Setenv(keyEnv, string(data))
+}
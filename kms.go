@@ -0,0 +1,232 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A KMS key is a recipient like any other: 'gitenc add-user
+// vault-transit:<mount>/<key>' has the keys wrapped by the encrypt endpoint
+// of a Vault transit compatible KMS and commits them under
+// .gitenc/recipients/. Without a key file, unlock and the filters have the
+// KMS decrypt them again, once per gitenc process, so the keys are never
+// stored under .git/gitenc/keys.
+//
+// The KMS is at git config gitenc.kmsAddress, VAULT_ADDR by default. Its
+// token comes from git config gitenc.kmsToken, which is env:<variable>,
+// file:<path> or a !<command> printing it, and otherwise from VAULT_TOKEN or
+// the ~/.vault-token the vault CLI writes.
+
+const transitPrefix = "vault-transit:"
+
+var kmsClient = &http.Client{Timeout: 30 * time.Second}
+
+type TransitRecipient struct {
+	mount string
+	name  string
+}
+
+func parseTransitRecipient(s string) (*TransitRecipient, error) {
+	path := strings.Trim(s[len(transitPrefix):], "/")
+	i := strings.LastIndex(path, "/")
+	if i <= 0 || i == len(path)-1 {
+		return nil, fmt.Errorf("invalid vault transit key, use %s<mount>/<key>: %s", transitPrefix, s)
+	}
+	return &TransitRecipient{path[:i], path[i+1:]}, nil
+}
+
+func (r *TransitRecipient) String() string {
+	return transitPrefix + r.mount + "/" + r.name
+}
+
+// Wrap returns the ciphertext the KMS gives for key, as is.
+func (r *TransitRecipient) Wrap(key []byte) ([]byte, error) {
+	data, err := r.call("encrypt", map[string]string{"plaintext": base64.StdEncoding.EncodeToString(key)})
+	if err != nil {
+		return nil, err
+	}
+	if data.Ciphertext == "" {
+		return nil, errors.New("the KMS returned no ciphertext")
+	}
+	return []byte(data.Ciphertext), nil
+}
+
+// The KMS holds the secret part of the recipient, so it is its own
+// identity.
+
+func (r *TransitRecipient) Recipient() Recipient {
+	return r
+}
+
+func (r *TransitRecipient) Unwrap(wrapped []byte) ([]byte, error) {
+	data, err := r.call("decrypt", map[string]string{"ciphertext": string(wrapped)})
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(data.Plaintext)
+}
+
+// transitData is the part of the data of a transit answer gitenc uses, the
+// KMS also sends fields such as key_version.
+type transitData struct {
+	Ciphertext string `json:"ciphertext"`
+	Plaintext  string `json:"plaintext"`
+}
+
+// call posts request to the op endpoint of the key and returns the data of
+// the answer.
+func (r *TransitRecipient) call(op string, request map[string]string) (*transitData, error) {
+	address := GetGitConfig("gitenc.kmsAddress")
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	if address == "" {
+		return nil, errors.New("no KMS address, set git config gitenc.kmsAddress or VAULT_ADDR")
+	}
+	token, err := kmsToken()
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	url := strings.TrimSuffix(address, "/") + "/v1/" + r.mount + "/" + op + "/" + r.name
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := kmsClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var answer struct {
+		Data   transitData `json:"data"`
+		Errors []string    `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("invalid answer from the KMS: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if len(answer.Errors) > 0 {
+			return nil, fmt.Errorf("KMS %s failed: %s", op, strings.Join(answer.Errors, ", "))
+		}
+		return nil, fmt.Errorf("KMS %s failed: %s", op, resp.Status)
+	}
+	return &answer.Data, nil
+}
+
+var (
+	kmsTokenOnce  sync.Once
+	kmsTokenValue string
+	kmsTokenErr   error
+)
+
+func kmsToken() (string, error) {
+	kmsTokenOnce.Do(func() {
+		kmsTokenValue, kmsTokenErr = readKMSToken(GetGitConfig("gitenc.kmsToken"))
+		if kmsTokenErr == nil && kmsTokenValue == "" {
+			kmsTokenErr = errors.New("no KMS token, set VAULT_TOKEN or git config gitenc.kmsToken")
+		}
+	})
+	return kmsTokenValue, kmsTokenErr
+}
+
+func readKMSToken(source string) (string, error) {
+	if source == "" {
+		if token := os.Getenv("VAULT_TOKEN"); token != "" {
+			return token, nil
+		}
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", nil
+		}
+		source = "file:" + filepath.Join(home, ".vault-token")
+	}
+	if name, ok := cutPrefix(source, "env:"); ok {
+		return os.Getenv(name), nil
+	}
+	if path, ok := cutPrefix(source, "file:"); ok {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return strings.TrimSpace(string(data)), err
+	}
+	if command, ok := cutPrefix(source, "!"); ok {
+		// the command may ask the user on the terminal
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("KMS token command failed: %v", err)
+		}
+		return strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0]), nil
+	}
+	return "", fmt.Errorf("invalid gitenc.kmsToken %q, use env:<variable>, file:<path> or !<command>", source)
+}
+
+var (
+	kmsMu   sync.Mutex
+	kmsKeys = map[string][][]byte{}
+)
+
+// transitKeys returns the keys of keyName unwrapped by the KMS, or nil when
+// they were not added for a KMS key.
+func transitKeys(keyName string) ([][]byte, error) {
+	kmsMu.Lock()
+	defer kmsMu.Unlock()
+	if keys, ok := kmsKeys[keyName]; ok {
+		return append([][]byte(nil), keys...), nil
+	}
+	var keys [][]byte
+	for _, file := range listRecipients(keyName) {
+		value, _, err := readRecipient(file)
+		if err != nil || !strings.HasPrefix(value, transitPrefix) {
+			continue
+		}
+		recipient, err := parseTransitRecipient(value)
+		if err != nil {
+			return nil, err
+		}
+		if keys, err = unwrapKeys(keyName, recipient); err != nil {
+			return nil, fmt.Errorf("%s: %v", recipient, err)
+		}
+		break
+	}
+	kmsKeys[keyName] = keys
+	return append([][]byte(nil), keys...), nil
+}
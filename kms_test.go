@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testKMSToken = "hvs.test"
+
+// Answers as Vault 1.15 sends them for transit encrypt and decrypt.
+const (
+	vaultEncryptAnswer = `{"request_id":"6c9c5b1e-8d0e-4f3c-9f8a-2a5d1f0f6b11","lease_id":"","renewable":false,"lease_duration":0,"data":{"ciphertext":"vault:v1:%s","key_version":1},"wrap_info":null,"warnings":null,"auth":null,"mount_type":"transit"}`
+	vaultDecryptAnswer = `{"request_id":"0d6f3a2c-1b7e-4c55-a0f2-9e3b8c7d4a21","lease_id":"","renewable":false,"lease_duration":0,"data":{"plaintext":"%s"},"wrap_info":null,"warnings":null,"auth":null,"mount_type":"transit"}`
+	vaultDeniedAnswer  = `{"errors":["1 error occurred:\n\t* permission denied\n\n"]}`
+)
+
+// newTransitServer returns a transit engine mounted at transit that
+// "encrypts" by tagging the plaintext it was given.
+func newTransitServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != testKMSToken {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, vaultDeniedAnswer)
+			return
+		}
+		var request map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/gitenc":
+			fmt.Fprintf(w, vaultEncryptAnswer, request["plaintext"])
+		case "/v1/transit/decrypt/gitenc":
+			fmt.Fprintf(w, vaultDecryptAnswer, strings.TrimPrefix(request["ciphertext"], "vault:v1:"))
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, vaultDeniedAnswer)
+		}
+	}))
+	t.Cleanup(server.Close)
+	// gitenc.kmsAddress and gitenc.kmsToken must not come from the user's
+	// git config
+	t.Setenv("GIT_CONFIG_GLOBAL", "/dev/null")
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("VAULT_ADDR", server.URL)
+	t.Setenv("VAULT_TOKEN", testKMSToken)
+	return server
+}
+
+func TestTransitWrapUnwrap(t *testing.T) {
+	newTransitServer(t)
+	recipient, err := parseTransitRecipient("vault-transit:transit/gitenc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := bytes.Repeat([]byte{0x5a}, 32)
+	wrapped, err := recipient.Wrap(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(wrapped), "vault:v1:") {
+		t.Fatalf("wrapped key is %q, want the ciphertext of the KMS", wrapped)
+	}
+	unwrapped, err := recipient.Unwrap(wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, key) {
+		t.Fatalf("unwrapped %x, want %x", unwrapped, key)
+	}
+}
+
+func TestTransitError(t *testing.T) {
+	newTransitServer(t)
+	recipient, err := parseTransitRecipient("vault-transit:transit/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = recipient.Wrap(make([]byte, 32))
+	if err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("Wrap with a denied key returned %v, want permission denied", err)
+	}
+}
@@ -0,0 +1,250 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	log "gitenc/log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// 'gitenc migrate' takes over the files another tool encrypted: their
+// blobs in the index are decrypted with that tool's key, the drivers in
+// .gitattributes are switched to gitenc and everything is committed again
+// encrypted by gitenc, in a single commit. Older commits still need the
+// other tool to be read.
+
+// migrationSource is a tool that can be migrated from.
+type migrationSource struct {
+	Name string
+	// Driver is the filter and diff driver of the files the tool encrypts.
+	Driver      string
+	IsEncrypted func(blob []byte) bool
+	Decrypt     func(blob []byte) ([]byte, error)
+}
+
+func Migrate(cmd MigrateCommand) {
+	var source *migrationSource
+	var err error
+	switch cmd.From {
+	case "git-crypt":
+		source, err = gitCryptSource(cmd.FromKey)
+	case "transcrypt":
+		source, err = transcryptSource(cmd.FromKey, cmd.FromCipher)
+	case "":
+		log.Error("Missing -from, the tool to migrate from: git-crypt or transcrypt")
+		return
+	default:
+		log.Error("Unknown tool to migrate from:", cmd.From+", use git-crypt or transcrypt")
+		return
+	}
+	if err != nil {
+		log.Error("Error reading", cmd.From, "key", err)
+		return
+	}
+	if err := migrate(cmd, source); err != nil {
+		log.Error("Migration from", source.Name, "failed:", err)
+		os.Exit(1)
+	}
+}
+
+// read returns the plaintext of file as it is in the index.
+func (s *migrationSource) read(file string) ([]byte, error) {
+	// git cat-file blob :filename
+	blob, err := exec.Command("git", "cat-file", "blob", ":"+file).Output()
+	if err != nil {
+		return nil, err
+	}
+	if !s.IsEncrypted(blob) {
+		// empty files are left alone by both tools
+		if len(blob) > 0 {
+			log.Warning(file, "is not encrypted by", s.Name+", it is taken as it is")
+		}
+		return blob, nil
+	}
+	return s.Decrypt(blob)
+}
+
+func migrate(cmd MigrateCommand, source *migrationSource) error {
+	// git diff --cached --name-only
+	if _, output := RunCommand("git", "diff", "--cached", "--name-only"); Trim(output) != "" {
+		return errors.New("the index has staged changes, commit or unstage them first")
+	}
+	files, attributes := sourceFiles(source.Driver)
+	if len(files) == 0 {
+		return fmt.Errorf("no files have filter=%s diff=%s", source.Driver, source.Driver)
+	}
+	// check everything before the working tree is touched
+	for _, file := range files {
+		plaintext, err := source.read(file)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		if data, err := os.ReadFile(file); err == nil && !source.IsEncrypted(data) && !bytes.Equal(data, plaintext) {
+			return fmt.Errorf("%s has uncommitted changes, commit or stash them first", file)
+		}
+	}
+
+	keyPath, keyName := GetKeyPath(cmd.KeyName)
+	if err := migrationKey(cmd, keyPath, keyName); err != nil {
+		return err
+	}
+	driver := "gitenc-" + keyName
+	if keyName == primaryKeyName() {
+		driver = "gitenc"
+	}
+	changed, err := replaceDriver(attributes, source.Driver, driver)
+	if err != nil {
+		return err
+	}
+	SetGitConfig(keyName)
+	for _, file := range files {
+		plaintext, err := source.read(file)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		// keep the mode of the file, a new one gets the usual mode
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(plaintext)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		log.Info("Decrypted file:", file)
+	}
+	if err := reencrypt(files, "Migrate from "+source.Name+" to gitenc", changed...); err != nil {
+		return fmt.Errorf("error re-encrypting files: %v", err)
+	}
+	log.Info("Migrated", len(files), "files from", source.Name, "to gitenc key", keyName)
+	log.Info("Older commits still need", source.Name, "to be read. Share the key with 'gitenc add-user' or 'gitenc key export'")
+	return nil
+}
+
+// migrationKey makes sure the gitenc key exists and can be read by the
+// filters, creating it when the repository does not use gitenc yet.
+func migrationKey(cmd MigrateCommand, keyPath, keyName string) error {
+	if haveKey(keyPath, keyName) {
+		_, err := unlockKeys(keyPath, keyName)
+		return err
+	}
+	initialized := fileExists(keyPath)
+	command := KeyCommand{
+		Key:        cmd.Key,
+		KDFTime:    DefaultKDFTime,
+		KDFMemory:  DefaultKDFMemory / 1024,
+		KDFThreads: DefaultKDFThreads,
+	}
+	key, params, _, err := newKey(command, keyName)
+	if err != nil {
+		return fmt.Errorf("error generating key: %v", err)
+	}
+	if err := writeKey(keyPath, keyName, key, params); err != nil {
+		return err
+	}
+	if !initialized && cmd.KeyName != "" {
+		// the plain gitenc driver encrypts with this key
+		RunCommand("git", "config", "gitenc.keyname", keyName)
+	}
+	log.Info("Generated gitenc key", keyName)
+	return nil
+}
+
+// sourceFiles returns the files in the index with driver as their filter
+// and diff driver, and the .gitattributes files.
+func sourceFiles(driver string) ([]string, []string) {
+	//git ls-files -cz -- .
+	_, output := RunCommand("git", "ls-files", "-cz", "--", getRepoRoot())
+	files := make([]string, 0)
+	attributes := make([]string, 0)
+	for _, file := range strings.Split(output, "\000") {
+		if file == "" {
+			continue
+		}
+		if filepath.Base(file) == ".gitattributes" {
+			attributes = append(attributes, file)
+		} else if fileDriver(file) == driver {
+			files = append(files, file)
+		}
+	}
+	return files, attributes
+}
+
+// replaceDriver switches the filter and diff attributes from one driver to
+// another in the given .gitattributes files and returns those it changed. A
+// merge driver of the same name is dropped, it would not understand gitenc
+// blobs.
+func replaceDriver(attributes []string, from, to string) ([]string, error) {
+	changed := make([]string, 0)
+	for _, file := range attributes {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		lines := strings.Split(string(data), "\n")
+		modified := false
+		for i, line := range lines {
+			fields := strings.Fields(line)
+			if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			replaced := false
+			attrs := fields[:1]
+			for _, attr := range fields[1:] {
+				switch attr {
+				case "filter=" + from:
+					attr = "filter=" + to
+				case "diff=" + from:
+					attr = "diff=" + to
+				case "merge=" + from:
+					replaced = true
+					continue
+				default:
+					attrs = append(attrs, attr)
+					continue
+				}
+				attrs = append(attrs, attr)
+				replaced = true
+			}
+			if replaced {
+				lines[i] = strings.Join(attrs, " ")
+				modified = true
+			}
+		}
+		if !modified {
+			continue
+		}
+		if err := os.WriteFile(file, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+			return nil, err
+		}
+		changed = append(changed, file)
+	}
+	return changed, nil
+}
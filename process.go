@@ -0,0 +1,395 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	log "gitenc/log"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// filter-process speaks git's long-running filter protocol (see
+// gitattributes(5), "Long Running Filter Process") over stdin and stdout,
+// so that one process with the keys loaded once serves a whole checkout.
+// Smudge requests that git allows to be delayed are decrypted by a pool of
+// workers while git goes on sending files, and handed back when git asks
+// for the available blobs.
+
+const (
+	pktMaxData = 65516
+	// delayMemory bounds the blobs held in memory for delayed requests,
+	// anything beyond that is smudged right away.
+	delayMemory = 256 << 20
+)
+
+type pktReader struct {
+	r *bufio.Reader
+}
+
+// readPacket returns the payload of the next packet, nil for a flush.
+func (p *pktReader) readPacket() ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(p.r, size[:]); err != nil {
+		return nil, err
+	}
+	n, err := strconv.ParseUint(string(size[:]), 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid packet length %q", size)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	if n <= 4 {
+		return nil, fmt.Errorf("invalid packet length %d", n)
+	}
+	data := make([]byte, n-4)
+	_, err = io.ReadFull(p.r, data)
+	return data, err
+}
+
+// readList reads text packets up to the next flush.
+func (p *pktReader) readList() ([]string, error) {
+	list := make([]string, 0)
+	for {
+		data, err := p.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			return list, nil
+		}
+		list = append(list, strings.TrimSuffix(string(data), "\n"))
+	}
+}
+
+// contentReader reads packet payloads up to the next flush.
+type contentReader struct {
+	p    *pktReader
+	buf  []byte
+	done bool
+}
+
+func (c *contentReader) Read(b []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		data, err := c.p.readPacket()
+		if err != nil {
+			return 0, err
+		}
+		if data == nil {
+			c.done = true
+		}
+		c.buf = data
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+type pktWriter struct {
+	w *bufio.Writer
+}
+
+func (p *pktWriter) writePacket(data []byte) error {
+	if _, err := fmt.Fprintf(p.w, "%04x", len(data)+4); err != nil {
+		return err
+	}
+	_, err := p.w.Write(data)
+	return err
+}
+
+func (p *pktWriter) flush() error {
+	if _, err := p.w.WriteString("0000"); err != nil {
+		return err
+	}
+	return p.w.Flush()
+}
+
+func (p *pktWriter) writeList(list ...string) error {
+	for _, line := range list {
+		if err := p.writePacket([]byte(line + "\n")); err != nil {
+			return err
+		}
+	}
+	return p.flush()
+}
+
+// Write sends b as content packets.
+func (p *pktWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > pktMaxData {
+			n = pktMaxData
+		}
+		if err := p.writePacket(b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+type filterRequest struct {
+	Command  string
+	Pathname string
+	CanDelay bool
+}
+
+func parseRequest(list []string) filterRequest {
+	var req filterRequest
+	for _, line := range list {
+		key, value, _ := strings.Cut(line, "=")
+		switch key {
+		case "command":
+			req.Command = value
+		case "pathname":
+			req.Pathname = value
+		case "can-delay":
+			req.CanDelay = value == "1"
+		}
+	}
+	return req
+}
+
+// delayedBlob is the result of a delayed smudge.
+type delayedBlob struct {
+	output []byte
+	err    error
+}
+
+type filterProcess struct {
+	in  *pktReader
+	out *pktWriter
+
+	keys     [][]byte
+	keysErr  error
+	opts     BlobOptions
+	optsErr  error
+	repoID   string
+	canDelay bool
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending int
+	memory  int
+	done    map[string]*delayedBlob
+	workers chan struct{}
+}
+
+func FilterProcess(cmd KeyCommand) {
+	keyPath, keyName := GetKeyPath(cmd.KeyName)
+	p := &filterProcess{
+		in:      &pktReader{bufio.NewReaderSize(os.Stdin, pktMaxData+4)},
+		out:     &pktWriter{bufio.NewWriterSize(os.Stdout, pktMaxData+4)},
+		repoID:  repoID(),
+		done:    make(map[string]*delayedBlob),
+		workers: make(chan struct{}, runtime.NumCPU()),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	p.keys, p.keysErr = loadKeys(keyPath, keyName)
+	p.opts, p.optsErr = repoBlobOptions(keyPath, keyName)
+	if err := p.handshake(); err != nil {
+		log.Error("filter-process:", err)
+		os.Exit(1)
+	}
+	for {
+		list, err := p.in.readList()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			log.Error("filter-process:", err)
+			os.Exit(1)
+		}
+		if err := p.handle(parseRequest(list)); err != nil {
+			log.Error("filter-process:", err)
+			os.Exit(1)
+		}
+	}
+}
+
+func (p *filterProcess) handshake() error {
+	list, err := p.in.readList()
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 || list[0] != "git-filter-client" {
+		return errors.New("not a git filter client")
+	}
+	version := false
+	for _, line := range list[1:] {
+		version = version || line == "version=2"
+	}
+	if !version {
+		return errors.New("git does not support filter protocol version 2")
+	}
+	if err := p.out.writeList("git-filter-server", "version=2"); err != nil {
+		return err
+	}
+	if list, err = p.in.readList(); err != nil {
+		return err
+	}
+	capabilities := make([]string, 0)
+	for _, line := range list {
+		switch line {
+		case "capability=clean", "capability=smudge":
+			capabilities = append(capabilities, line)
+		case "capability=delay":
+			p.canDelay = true
+			capabilities = append(capabilities, line)
+		}
+	}
+	return p.out.writeList(capabilities...)
+}
+
+func (p *filterProcess) handle(req filterRequest) error {
+	if req.Command == "list_available_blobs" {
+		return p.listAvailable()
+	}
+	// the whole content is read before answering, git does not read the
+	// answer while it is still sending
+	cr := &contentReader{p: p.in}
+	var buf bytes.Buffer
+	var content io.ReadCloser
+	inMemory := false
+	if _, err := io.CopyN(&buf, cr, spoolMemory); err == io.EOF {
+		content = io.NopCloser(&buf)
+		inMemory = true
+	} else if err != nil {
+		return err
+	} else if content, err = spool(io.MultiReader(&buf, cr), io.Discard); err != nil {
+		return err
+	}
+	defer content.Close()
+
+	switch req.Command {
+	case "clean":
+		return p.respond(req, func(w io.Writer) error {
+			if p.keysErr != nil {
+				return fmt.Errorf("error reading key: %v", p.keysErr)
+			}
+			if p.optsErr != nil {
+				return p.optsErr
+			}
+			return cleanBlob(w, content, p.keys[0], p.opts, req.Pathname)
+		})
+	case "smudge":
+		p.mu.Lock()
+		blob, ok := p.done[req.Pathname]
+		if ok {
+			delete(p.done, req.Pathname)
+			p.memory -= len(blob.output)
+		}
+		p.mu.Unlock()
+		if ok {
+			// git fetches a blob it was told is available
+			return p.respond(req, func(w io.Writer) error {
+				if blob.err != nil {
+					return blob.err
+				}
+				_, err := w.Write(blob.output)
+				return err
+			})
+		}
+		if req.CanDelay && p.canDelay && inMemory && p.reserve(buf.Len()) {
+			go p.smudgeDelayed(req.Pathname, buf.Bytes())
+			return p.out.writeList("status=delayed")
+		}
+		return p.respond(req, func(w io.Writer) error {
+			return smudgeBlob(w, content, p.keys, p.keysErr, req.Pathname, p.repoID)
+		})
+	}
+	return p.out.writeList("status=error")
+}
+
+// respond sends the output of filter. An error after some of the output was
+// sent is still reported, git then discards what it got.
+func (p *filterProcess) respond(req filterRequest, filter func(w io.Writer) error) error {
+	if err := p.out.writeList("status=success"); err != nil {
+		return err
+	}
+	filterErr := filter(p.out)
+	if err := p.out.flush(); err != nil {
+		return err
+	}
+	if filterErr != nil {
+		log.Error("Error in", req.Command, "of", req.Pathname+":", filterErr)
+		return p.out.writeList("status=error")
+	}
+	// an empty list keeps the status
+	return p.out.writeList()
+}
+
+// reserve accounts for a delayed blob of size bytes, or reports that too
+// much is held in memory already.
+func (p *filterProcess) reserve(size int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.memory+size > delayMemory {
+		return false
+	}
+	p.memory += size
+	p.pending++
+	return true
+}
+
+func (p *filterProcess) smudgeDelayed(pathname string, content []byte) {
+	p.workers <- struct{}{}
+	var out bytes.Buffer
+	err := smudgeBlob(&out, bytes.NewReader(content), p.keys, p.keysErr, pathname, p.repoID)
+	<-p.workers
+
+	p.mu.Lock()
+	p.memory += out.Len() - len(content)
+	p.pending--
+	p.done[pathname] = &delayedBlob{out.Bytes(), err}
+	p.cond.Broadcast()
+	p.mu.Unlock()
+}
+
+// listAvailable waits for at least one delayed blob, unless none are left,
+// and lists those that are done.
+func (p *filterProcess) listAvailable() error {
+	p.mu.Lock()
+	for p.pending > 0 && len(p.done) == 0 {
+		p.cond.Wait()
+	}
+	list := make([]string, 0, len(p.done))
+	for pathname := range p.done {
+		list = append(list, "pathname="+pathname)
+	}
+	p.mu.Unlock()
+	if err := p.out.writeList(list...); err != nil {
+		return err
+	}
+	return p.out.writeList("status=success")
+}
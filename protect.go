@@ -0,0 +1,291 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/term"
+)
+
+// A protected key file holds the key sealed under a passphrase instead of
+// the raw key:
+//
+//	magic (4) | version (1) | params length (1) | argon2id params | nonce (24) | sealed key
+//
+// Everything before the nonce is authenticated along with the key. Once
+// 'gitenc unlock' asked for the passphrase, the derived wrapping key is
+// cached in the user's runtime directory, so that the filters can read the
+// key without prompting until 'gitenc lock' or the end of the session.
+
+const protectedKeyVersion = 1
+
+var protectedKeyMagic = []byte("\x00MRK")
+
+var errKeyLocked = errors.New("the key is protected by a passphrase, run 'gitenc unlock' first")
+
+type keyProtection struct {
+	params  *KDFParams
+	wrapKey []byte
+}
+
+func isProtectedKey(data []byte) bool {
+	return bytes.HasPrefix(data, protectedKeyMagic)
+}
+
+// newKeyProtection derives a wrapping key from passphrase with fresh
+// argon2id parameters.
+func newKeyProtection(passphrase string, command KeyCommand) (*keyProtection, error) {
+	params, err := NewKDFParams(uint32(command.KDFTime), uint32(command.KDFMemory)*1024, uint8(command.KDFThreads))
+	if err != nil {
+		return nil, err
+	}
+	wrapKey, err := DeriveKey(passphrase, params)
+	if err != nil {
+		return nil, err
+	}
+	return &keyProtection{params, wrapKey}, nil
+}
+
+func (p *keyProtection) seal(key []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(p.wrapKey)
+	if err != nil {
+		return nil, err
+	}
+	params := p.params.Bytes()
+	out := append(append([]byte{}, protectedKeyMagic...), protectedKeyVersion, byte(len(params)))
+	out = append(out, params...)
+	// the additional data must not overlap the output
+	ad := append([]byte{}, out...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, key, ad), nil
+}
+
+// parseProtectedKey splits a protected key file into its parameters, the
+// authenticated prefix and the nonce and sealed key that follow it.
+func parseProtectedKey(data []byte) (*KDFParams, []byte, []byte, error) {
+	n := len(protectedKeyMagic)
+	if !isProtectedKey(data) || len(data) < n+2 {
+		return nil, nil, nil, errors.New("not a protected key")
+	}
+	if data[n] != protectedKeyVersion {
+		return nil, nil, nil, fmt.Errorf("unsupported protected key version %d", data[n])
+	}
+	end := n + 2 + int(data[n+1])
+	if len(data) < end {
+		return nil, nil, nil, errors.New("truncated protected key")
+	}
+	params, err := ParseKDFParams(KDFArgon2id, data[n+2:end])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return params, data[:end], data[end:], nil
+}
+
+func (p *keyProtection) open(data []byte) ([]byte, error) {
+	_, ad, sealed, err := parseProtectedKey(data)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(p.wrapKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("truncated protected key")
+	}
+	key, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], ad)
+	if err != nil {
+		return nil, errors.New("wrong passphrase")
+	}
+	return key, nil
+}
+
+// sessionDir is where unlocked wrapping keys are cached. The runtime
+// directory is private to the user and cleared when they log out.
+func sessionDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "gitenc")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("gitenc-%d", os.Getuid()))
+}
+
+func sessionFile(params *KDFParams) string {
+	sum := sha256.Sum256(params.Bytes())
+	return filepath.Join(sessionDir(), hex.EncodeToString(sum[:16]))
+}
+
+func cachedProtection(params *KDFParams) *keyProtection {
+	wrapKey, err := os.ReadFile(sessionFile(params))
+	if err != nil || len(wrapKey) != chacha20poly1305.KeySize {
+		return nil
+	}
+	return &keyProtection{params, wrapKey}
+}
+
+func (p *keyProtection) cache() error {
+	if err := os.MkdirAll(sessionDir(), 0700); err != nil {
+		return err
+	}
+	// the directory may have been created by someone else in a shared /tmp
+	if info, err := os.Lstat(sessionDir()); err != nil || !info.IsDir() || info.Mode().Perm() != 0700 || !ownedByUser(info) {
+		return fmt.Errorf("%s is not a private directory", sessionDir())
+	}
+	return os.WriteFile(sessionFile(p.params), p.wrapKey, 0600)
+}
+
+// forgetProtection drops the cached wrapping key of the key file at path.
+func forgetProtection(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil || !isProtectedKey(data) {
+		return
+	}
+	if params, _, _, err := parseProtectedKey(data); err == nil {
+		os.Remove(sessionFile(params))
+	}
+}
+
+// readKeyFile returns the key stored at path. Protected keys are only
+// opened when their wrapping key is cached, this never prompts.
+func readKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil || !isProtectedKey(data) {
+		return data, err
+	}
+	params, _, _, err := parseProtectedKey(data)
+	if err != nil {
+		return nil, err
+	}
+	protection := cachedProtection(params)
+	if protection == nil {
+		return nil, errKeyLocked
+	}
+	return protection.open(data)
+}
+
+// protectionOf returns how the key file at path is protected, or nil for a
+// raw or missing key. When the wrapping key is not cached yet, it asks for
+// the passphrase and caches it.
+func protectionOf(path string) (*keyProtection, error) {
+	data, err := os.ReadFile(path)
+	if err != nil || !isProtectedKey(data) {
+		return nil, nil
+	}
+	params, _, _, err := parseProtectedKey(data)
+	if err != nil {
+		return nil, err
+	}
+	if protection := cachedProtection(params); protection != nil {
+		return protection, nil
+	}
+	passphrase, err := readPassphrase("Passphrase for " + filepath.Base(path) + ": ")
+	if err != nil {
+		return nil, err
+	}
+	wrapKey, err := DeriveKey(passphrase, params)
+	if err != nil {
+		return nil, err
+	}
+	protection := &keyProtection{params, wrapKey}
+	if _, err := protection.open(data); err != nil {
+		return nil, err
+	}
+	return protection, protection.cache()
+}
+
+// writeKeyFile writes key to path, sealed when protection is set.
+func writeKeyFile(path string, key []byte, protection *keyProtection) error {
+	if protection != nil {
+		sealed, err := protection.seal(key)
+		if err != nil {
+			return err
+		}
+		key = sealed
+	}
+	return os.WriteFile(path, key, 0600)
+}
+
+// readPassphrase prompts on the terminal without echo. When stdin is not a
+// terminal the passphrase is read from its next line, one byte at a time so
+// that later prompts still get their input.
+func readPassphrase(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return string(passphrase), err
+	}
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := os.Stdin.Read(b); err != nil {
+			if len(line) == 0 {
+				return "", err
+			}
+			break
+		} else if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+	return strings.TrimSuffix(string(line), "\r"), nil
+}
+
+// askProtection asks for a new passphrase and derives a protection from it.
+func askProtection(command KeyCommand) (*keyProtection, error) {
+	passphrase, err := newPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	return newKeyProtection(passphrase, command)
+}
+
+// newPassphrase asks for a new passphrase twice.
+func newPassphrase() (string, error) {
+	passphrase, err := readPassphrase("New passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase == "" {
+		return "", errors.New("empty passphrase")
+	}
+	confirm, err := readPassphrase("Repeat passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase != confirm {
+		return "", errors.New("passphrases do not match")
+	}
+	return passphrase, nil
+}
@@ -0,0 +1,338 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// The repository keys are wrapped for every recipient into a file under
+// .gitenc/recipients/<keyname>/, which is committed with the repository:
+//
+//	recipient: x25519:<base64 public key>
+//	key: <key id> <base64 wrapped key>
+//	key: ...
+//
+// The first key is the current one, the others come from the keyring so
+// that older commits stay readable.
+
+const (
+	x25519Prefix         = "x25519:"
+	x25519IdentityPrefix = "GITENC-X25519-IDENTITY:"
+)
+
+type Recipient interface {
+	// String returns the recipient as written in the recipients file.
+	String() string
+	Wrap(key []byte) ([]byte, error)
+}
+
+type Identity interface {
+	Recipient() Recipient
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+type X25519Recipient struct {
+	publicKey []byte
+}
+
+type X25519Identity struct {
+	secretKey []byte
+}
+
+func (r *X25519Recipient) String() string {
+	return x25519Prefix + base64.StdEncoding.EncodeToString(r.publicKey)
+}
+
+func x25519WrapKey(shared, ephemeral, publicKey []byte, label string) ([]byte, error) {
+	wrapKey := make([]byte, chacha20poly1305.KeySize)
+	salt := append(append([]byte{}, ephemeral...), publicKey...)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(label)), wrapKey); err != nil {
+		return nil, err
+	}
+	return wrapKey, nil
+}
+
+// x25519Wrap seals key for publicKey with a fresh ephemeral X25519 key and
+// returns the ephemeral public key followed by the sealed key. The label
+// tells apart the kinds of recipients using it.
+func x25519Wrap(publicKey, key []byte, label string) ([]byte, error) {
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(ephemeral); err != nil {
+		return nil, err
+	}
+	ephemeralPublic, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(ephemeral, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	wrapKey, err := x25519WrapKey(shared, ephemeralPublic, publicKey, label)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(wrapKey)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(ephemeralPublic, make([]byte, aead.NonceSize()), key, nil), nil
+}
+
+func x25519Unwrap(secretKey, wrapped []byte, label string) ([]byte, error) {
+	if len(wrapped) < curve25519.PointSize {
+		return nil, errors.New("wrapped key is too short")
+	}
+	ephemeralPublic := wrapped[:curve25519.PointSize]
+	shared, err := curve25519.X25519(secretKey, ephemeralPublic)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := curve25519.X25519(secretKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	wrapKey, err := x25519WrapKey(shared, ephemeralPublic, publicKey, label)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(wrapKey)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, aead.NonceSize()), wrapped[curve25519.PointSize:], nil)
+}
+
+func (r *X25519Recipient) Wrap(key []byte) ([]byte, error) {
+	return x25519Wrap(r.publicKey, key, "gitenc x25519")
+}
+
+func (i *X25519Identity) Recipient() Recipient {
+	publicKey, _ := curve25519.X25519(i.secretKey, curve25519.Basepoint)
+	return &X25519Recipient{publicKey}
+}
+
+func (i *X25519Identity) Unwrap(wrapped []byte) ([]byte, error) {
+	return x25519Unwrap(i.secretKey, wrapped, "gitenc x25519")
+}
+
+func NewX25519Identity() (*X25519Identity, error) {
+	secretKey := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(secretKey); err != nil {
+		return nil, err
+	}
+	return &X25519Identity{secretKey}, nil
+}
+
+func (i *X25519Identity) String() string {
+	return x25519IdentityPrefix + base64.StdEncoding.EncodeToString(i.secretKey)
+}
+
+func ParseRecipient(s string) (Recipient, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, x25519Prefix) {
+		publicKey, err := base64.StdEncoding.DecodeString(s[len(x25519Prefix):])
+		if err != nil || len(publicKey) != curve25519.PointSize {
+			return nil, fmt.Errorf("invalid x25519 recipient: %s", s)
+		}
+		return &X25519Recipient{publicKey}, nil
+	}
+	if strings.HasPrefix(s, transitPrefix) {
+		return parseTransitRecipient(s)
+	}
+	if isSSHRecipient(s) {
+		return parseSSHRecipient(s)
+	}
+	return nil, fmt.Errorf("unknown recipient type: %s", s)
+}
+
+func ParseIdentity(data []byte) (Identity, error) {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, x25519IdentityPrefix) {
+			secretKey, err := base64.StdEncoding.DecodeString(line[len(x25519IdentityPrefix):])
+			if err != nil || len(secretKey) != curve25519.ScalarSize {
+				return nil, errors.New("invalid x25519 identity")
+			}
+			return &X25519Identity{secretKey}, nil
+		}
+	}
+	return nil, errors.New("no identity found")
+}
+
+func DefaultIdentityPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "gitenc", "identity")
+}
+
+func recipientsDir(keyName string) string {
+	return getRepoRoot() + "/.gitenc/recipients/" + keyName + "/"
+}
+
+func recipientFile(keyName string, recipient Recipient) string {
+	sum := sha256.Sum256([]byte(recipient.String()))
+	return recipientsDir(keyName) + hex.EncodeToString(sum[:8])
+}
+
+type wrappedKey struct {
+	KeyID   string
+	Wrapped []byte
+}
+
+// writeRecipient wraps keys, the current one first, for recipient.
+func writeRecipient(keyName string, recipient Recipient, keys [][]byte) (string, error) {
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "recipient: %s\n", recipient)
+	for _, key := range keys {
+		wrapped, err := recipient.Wrap(key)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&out, "key: %s %s\n", hex.EncodeToString(KeyID(key)), base64.StdEncoding.EncodeToString(wrapped))
+	}
+	if err := os.MkdirAll(recipientsDir(keyName), 0755); err != nil {
+		return "", err
+	}
+	path := recipientFile(keyName, recipient)
+	return path, os.WriteFile(path, out.Bytes(), 0644)
+}
+
+func readRecipient(path string) (string, []wrappedKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	recipient := ""
+	keys := make([]wrappedKey, 0)
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := cutPrefix(line, "recipient: "); ok {
+			recipient = value
+		} else if value, ok := cutPrefix(line, "key: "); ok {
+			fields := strings.Fields(value)
+			if len(fields) != 2 {
+				return "", nil, fmt.Errorf("%s: invalid key line", path)
+			}
+			wrapped, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return "", nil, fmt.Errorf("%s: %v", path, err)
+			}
+			keys = append(keys, wrappedKey{fields[0], wrapped})
+		}
+	}
+	if recipient == "" {
+		return "", nil, fmt.Errorf("%s: missing recipient", path)
+	}
+	return recipient, keys, nil
+}
+
+func cutPrefix(s, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+	return strings.TrimSpace(s[len(prefix):]), true
+}
+
+// listRecipients returns the recipient files of keyName.
+func listRecipients(keyName string) []string {
+	entries, err := os.ReadDir(recipientsDir(keyName))
+	if err != nil {
+		return nil
+	}
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			files = append(files, recipientsDir(keyName)+entry.Name())
+		}
+	}
+	return files
+}
+
+// rewrapRecipients wraps the current keys of keyName again for every
+// recipient, e.g. after the key was rotated, and returns the files written.
+func rewrapRecipients(keyName string, keys [][]byte) ([]string, error) {
+	written := make([]string, 0)
+	for _, file := range listRecipients(keyName) {
+		value, _, err := readRecipient(file)
+		if err != nil {
+			return nil, err
+		}
+		recipient, err := ParseRecipient(value)
+		if err != nil {
+			return nil, err
+		}
+		path, err := writeRecipient(keyName, recipient, keys)
+		if err != nil {
+			return nil, err
+		}
+		written = append(written, path)
+	}
+	return written, nil
+}
+
+// unwrapKeys looks for the recipient file of identity and unwraps the keys
+// in it, the current key first.
+func unwrapKeys(keyName string, identity Identity) ([][]byte, error) {
+	recipient, keys, err := readRecipient(recipientFile(keyName, identity.Recipient()))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no key %s was added for %s", keyName, identity.Recipient())
+	} else if err != nil {
+		return nil, err
+	}
+	if recipient != identity.Recipient().String() {
+		return nil, fmt.Errorf("recipient file does not belong to %s", identity.Recipient())
+	}
+	unwrapped := make([][]byte, 0, len(keys))
+	for _, wrapped := range keys {
+		key, err := identity.Unwrap(wrapped.Wrapped)
+		if err != nil {
+			return nil, fmt.Errorf("unable to unwrap key %s: %v", wrapped.KeyID, err)
+		}
+		if hex.EncodeToString(KeyID(key)) != wrapped.KeyID {
+			return nil, fmt.Errorf("unwrapped key does not match key id %s", wrapped.KeyID)
+		}
+		unwrapped = append(unwrapped, key)
+	}
+	if len(unwrapped) == 0 {
+		return nil, errors.New("recipient file holds no keys")
+	}
+	return unwrapped, nil
+}
@@ -0,0 +1,203 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	log "gitenc/log"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// keyFiles returns the encrypted files of keyName in the index that one of
+// keys can decrypt.
+func keyFiles(keyName string, keys [][]byte) []string {
+	files := make([]string, 0)
+	for _, file := range getEncryptFiles(keyName) {
+		header, err := blobHeader(":" + file)
+		if err != nil {
+			continue
+		}
+		if _, err := findKey(header, keys); err == nil {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// checkReencrypt makes sure files can be cleaned again without picking up
+// unrelated changes or encrypting ciphertext twice. git status cannot tell,
+// since every clean produces a new ciphertext, so the plaintexts are
+// compared instead.
+func checkReencrypt(files []string, keys [][]byte) error {
+	if len(files) == 0 {
+		return nil
+	}
+	// git diff --cached --name-only
+	_, output := RunCommand("git", "diff", "--cached", "--name-only")
+	if Trim(output) != "" {
+		return errors.New("the index has staged changes, commit or unstage them first")
+	}
+	for _, file := range files {
+		if _, err := fileHeader(file); err == nil {
+			return fmt.Errorf("%s is still encrypted in the working tree, run 'gitenc unlock' first", file)
+		}
+		same, err := indexMatchesWorktree(file, keys)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		if !same {
+			return fmt.Errorf("%s has uncommitted changes, commit or stash them first", file)
+		}
+	}
+	return nil
+}
+
+func indexMatchesWorktree(file string, keys [][]byte) (bool, error) {
+	// git cat-file blob :filename
+	cmd := exec.Command("git", "cat-file", "blob", ":"+file)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return false, err
+	}
+	if err := cmd.Start(); err != nil {
+		return false, err
+	}
+	defer cmd.Wait()
+	in := bufio.NewReaderSize(out, MaxPeekSize)
+	header, size, err := PeekHeader(in)
+	if err != nil {
+		return false, err
+	}
+	key, err := findKey(header, keys)
+	if err != nil {
+		return false, err
+	}
+	payload, err := header.OpenPayload(in, size)
+	if err != nil {
+		return false, err
+	}
+	indexHash := sha256.New()
+	if err := decryptBlob(indexHash, header, payload, key); err != nil {
+		return false, err
+	}
+	io.Copy(io.Discard, in)
+
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	fileHash := sha256.New()
+	if _, err := io.Copy(fileHash, f); err != nil {
+		return false, err
+	}
+	return bytes.Equal(indexHash.Sum(nil), fileHash.Sum(nil)), nil
+}
+
+// reencrypt runs files through the clean filter again and commits the
+// result. Committing with a pathspec would clean the files a second time
+// and leave a different ciphertext in the index, so checkReencrypt makes
+// sure nothing else is staged instead.
+func reencrypt(files []string, message string, extra ...string) error {
+	if len(files) == 0 && len(extra) == 0 {
+		return nil
+	}
+	if len(files) > 0 {
+		// git add --renormalize -- files
+		if code, output := RunCommand("git", append([]string{"add", "--renormalize", "--"}, files...)...); code != 0 {
+			return errors.New(output)
+		}
+	}
+	if len(extra) > 0 {
+		// git add -- files
+		if code, output := RunCommand("git", append([]string{"add", "--"}, extra...)...); code != 0 {
+			return errors.New(output)
+		}
+	}
+	// git commit -m message
+	if code, output := RunCommand("git", "commit", "-m", message); code != 0 {
+		return errors.New(output)
+	}
+	return nil
+}
+
+// rotateKey replaces the key of keyName with a new one, keeps the old key
+// for decryption only, wraps the new key for the recipients and commits the
+// files re-encrypted with it. prepare runs once all checks passed and
+// returns further paths to commit along with them.
+func rotateKey(command KeyCommand, message string, prepare func(keys [][]byte) ([]string, error)) error {
+	keyPath, keyName := GetKeyPath(command.KeyName)
+	keys, err := unlockKeys(keyPath, keyName)
+	if os.IsNotExist(err) {
+		return errors.New("gitenc isnot initialized in this repository. Run 'gitenc init' to initialize it.")
+	} else if err != nil {
+		return err
+	}
+	files := keyFiles(keyName, keys)
+	if err := checkReencrypt(files, keys); err != nil {
+		return err
+	}
+	extra := make([]string, 0)
+	if prepare != nil {
+		if extra, err = prepare(keys); err != nil {
+			return err
+		}
+	}
+
+	key, params, _, err := newKey(command, keyName)
+	if err != nil {
+		return fmt.Errorf("error generating key: %v", err)
+	}
+	if _, err := findKey(&Header{KeyID: KeyID(key)}, keys); err == nil {
+		return errors.New("the new key is the same as an existing one")
+	}
+	if err := saveOldKey(keyPath, keyName, keys[0]); err != nil {
+		return err
+	}
+	if err := writeKey(keyPath, keyName, key, params); err != nil {
+		return err
+	}
+	log.Info("Key", keyName, "rotated, the previous key is kept for decryption only")
+	rewrapped, err := rewrapRecipients(keyName, append([][]byte{key}, keys...))
+	if err != nil {
+		return fmt.Errorf("error wrapping key: %v", err)
+	}
+
+	if err := reencrypt(files, message, append(extra, rewrapped...)...); err != nil {
+		return fmt.Errorf("error re-encrypting files: %v", err)
+	}
+	log.Info("Re-encrypted", len(files), "files")
+	return nil
+}
+
+func Rotate(command KeyCommand) {
+	_, keyName := GetKeyPath(command.KeyName)
+	if err := rotateKey(command, "Rotate gitenc key "+keyName, nil); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,240 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	log "gitenc/log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The keys are split with Shamir's secret sharing over GF(2^8), byte by
+// byte: every byte of the exported key data is the constant term of its own
+// random polynomial of degree threshold-1, and share x holds the values of
+// all polynomials at x. Any threshold shares give back the data, fewer
+// reveal nothing about it.
+//
+// Shares are armored like exported keys, with the same description of the
+// keys plus:
+//
+//	Split-ID: <random id shared by the shares of one split>
+//	Share: <x>
+//	Threshold: <k>
+//	Shares: <n>
+
+const armorShare = "GITENC KEY SHARE"
+
+// gfMul multiplies in GF(2^8) with the AES polynomial, without branching on
+// the operands.
+func gfMul(a, b byte) byte {
+	var p byte
+	for i := 0; i < 8; i++ {
+		p ^= -(b & 1) & a
+		a = (a << 1) ^ (-(a >> 7) & 0x1b)
+		b >>= 1
+	}
+	return p
+}
+
+// gfInv returns a^254, the inverse of a non-zero a.
+func gfInv(a byte) byte {
+	r := byte(1)
+	for i := 0; i < 7; i++ {
+		a = gfMul(a, a)
+		r = gfMul(r, a)
+	}
+	return r
+}
+
+// splitSecret returns n shares of secret, threshold of which are needed to
+// recover it. Share i is evaluated at x = i+1.
+func splitSecret(secret []byte, n, threshold int) ([][]byte, error) {
+	if threshold < 2 || threshold > n || n > 255 {
+		return nil, fmt.Errorf("invalid split: %d of %d shares", threshold, n)
+	}
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret))
+	}
+	coeffs := make([]byte, threshold)
+	for i, b := range secret {
+		coeffs[0] = b
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, err
+		}
+		for j := range shares {
+			x := byte(j + 1)
+			var y byte
+			for k := threshold - 1; k >= 0; k-- {
+				y = gfMul(y, x) ^ coeffs[k]
+			}
+			shares[j][i] = y
+		}
+	}
+	for i := range coeffs {
+		coeffs[i] = 0
+	}
+	return shares, nil
+}
+
+// combineSecret interpolates the shares, given as x -> values, at zero.
+func combineSecret(shares map[byte][]byte) ([]byte, error) {
+	var size = -1
+	for x, share := range shares {
+		if x == 0 {
+			return nil, errors.New("invalid share number 0")
+		}
+		if size >= 0 && len(share) != size {
+			return nil, errors.New("shares have different lengths")
+		}
+		size = len(share)
+	}
+	secret := make([]byte, size)
+	for xj, share := range shares {
+		// Lagrange basis polynomial of xj at zero
+		basis := byte(1)
+		for xm := range shares {
+			if xm != xj {
+				basis = gfMul(basis, gfMul(xm, gfInv(xm^xj)))
+			}
+		}
+		for i, y := range share {
+			secret[i] ^= gfMul(y, basis)
+		}
+	}
+	return secret, nil
+}
+
+func SplitKey(cmd KeyToolCommand) {
+	exported, err := exportedKeys(cmd.KeyName)
+	if err != nil {
+		log.Error("Error reading key", err)
+		return
+	}
+	n, threshold := int(cmd.Shares), int(cmd.Threshold)
+	shares, err := splitSecret(exported.payload(), n, threshold)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	splitID := make([]byte, 8)
+	if _, err := rand.Read(splitID); err != nil {
+		log.Error(err)
+		return
+	}
+	for i, share := range shares {
+		headers := append(exported.headers(),
+			"Split-ID: "+hex.EncodeToString(splitID),
+			"Share: "+strconv.Itoa(i+1),
+			"Threshold: "+strconv.Itoa(threshold),
+			"Shares: "+strconv.Itoa(n),
+		)
+		armored := armor(armorShare, headers, share)
+		if cmd.Output == "" {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Print(armored)
+			continue
+		}
+		file := cmd.Output + "." + strconv.Itoa(i+1)
+		if err := os.WriteFile(file, []byte(armored), 0600); err != nil {
+			log.Error("Error writing share", err)
+			return
+		}
+		log.Info("Share", i+1, "of key", exported.Name, "written to", file)
+	}
+	log.Info("Any", threshold, "of the", n, "shares recover the key with 'gitenc key combine'")
+}
+
+// CombineKey recovers a key from shares given as files, or read from stdin,
+// and installs it once it matches the encrypted files.
+func CombineKey(cmd KeyToolCommand, files []string) {
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	var text strings.Builder
+	for _, file := range files {
+		data, err := readInput(file)
+		if err != nil {
+			log.Error("Error reading share", err)
+			return
+		}
+		text.Write(data)
+		text.WriteString("\n")
+	}
+	blocks, err := parseArmor(armorShare, text.String())
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	first := blocks[0].Fields
+	shares := make(map[byte][]byte)
+	for _, block := range blocks {
+		if block.Fields["Split-ID"] != first["Split-ID"] || block.Fields["Key-ID"] != first["Key-ID"] {
+			log.Error("Shares come from different splits")
+			return
+		}
+		x, err := strconv.Atoi(block.Fields["Share"])
+		if err != nil || x < 1 || x > 255 {
+			log.Error("Invalid share number", block.Fields["Share"])
+			return
+		}
+		shares[byte(x)] = block.Payload
+	}
+	threshold, err := strconv.Atoi(first["Threshold"])
+	if err != nil {
+		log.Error("Invalid threshold", first["Threshold"])
+		return
+	}
+	if len(shares) < threshold {
+		log.Error("Got", len(shares), "distinct shares,", threshold, "are needed")
+		return
+	}
+	payload, err := combineSecret(shares)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	exported, err := parseExportedKey(first, payload)
+	if err != nil {
+		log.Error("Unable to recover the key:", err)
+		return
+	}
+	if cmd.KeyName == "" {
+		cmd.KeyName = exported.Name
+	}
+	keyPath, keyName := GetKeyPath(cmd.KeyName)
+	if _, err := verifyKeys(keyName, exported.Keys); err != nil {
+		log.Error(err)
+		return
+	}
+	if err := installKeys(keyPath, keyName, exported.Keys, exported.Params, cmd.Force); err != nil {
+		log.Error(err)
+		return
+	}
+	log.Info("Key", keyName, "recovered, run 'gitenc unlock' to decrypt the files")
+}
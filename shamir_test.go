@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGFMul(t *testing.T) {
+	// FIPS-197, section 4.2
+	for _, c := range []struct{ a, b, product byte }{
+		{0x57, 0x83, 0xc1},
+		{0x57, 0x13, 0xfe},
+		{0x57, 0x02, 0xae},
+		{0x57, 0x04, 0x47},
+		{0x57, 0x08, 0x8e},
+		{0x57, 0x10, 0x07},
+		{0x00, 0xff, 0x00},
+		{0x01, 0xff, 0xff},
+	} {
+		if p := gfMul(c.a, c.b); p != c.product {
+			t.Errorf("%#02x * %#02x = %#02x, want %#02x", c.a, c.b, p, c.product)
+		}
+		if p := gfMul(c.b, c.a); p != c.product {
+			t.Errorf("%#02x * %#02x = %#02x, want %#02x", c.b, c.a, p, c.product)
+		}
+	}
+}
+
+func TestGFInv(t *testing.T) {
+	// FIPS-197, section 5.1.1
+	if inv := gfInv(0x53); inv != 0xca {
+		t.Errorf("inverse of 0x53 is %#02x, want 0xca", inv)
+	}
+	for a := 1; a < 256; a++ {
+		if p := gfMul(byte(a), gfInv(byte(a))); p != 1 {
+			t.Errorf("%#02x times its inverse is %#02x", a, p)
+		}
+	}
+}
+
+func TestSplitCombine(t *testing.T) {
+	secret := randomBytes(t, 97)
+	const n = 5
+	for threshold := 2; threshold <= n; threshold++ {
+		shares, err := splitSecret(secret, n, threshold)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// every subset of the shares, as a bit mask
+		for subset := 1; subset < 1<<n; subset++ {
+			picked := make(map[byte][]byte)
+			for i := 0; i < n; i++ {
+				if subset&(1<<i) != 0 {
+					picked[byte(i+1)] = shares[i]
+				}
+			}
+			combined, err := combineSecret(picked)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if enough := len(picked) >= threshold; bytes.Equal(combined, secret) != enough {
+				t.Errorf("%d of %d shares %05b with threshold %d: recovered %v, want %v", len(picked), n, subset, threshold, !enough, enough)
+			}
+		}
+	}
+}
+
+func TestSplitInvalid(t *testing.T) {
+	for _, c := range []struct{ n, threshold int }{{3, 1}, {2, 3}, {256, 2}} {
+		if _, err := splitSecret([]byte{1}, c.n, c.threshold); err == nil {
+			t.Errorf("split of %d shares with threshold %d succeeded", c.n, c.threshold)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	log "gitenc/log"
+	"hash"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Anyone holding the key can write blobs that decrypt cleanly, signatures
+// tell who wrote them. With git config gitenc.sign set, clean appends an
+// Ed25519 signature to every blob, made with the committer's signing key
+// over the SHA-512 of the header and the encrypted payload. The header
+// names the signing key, so signatures can be checked without the
+// repository key.
+//
+// The keys whose signatures are trusted are committed in
+// .gitenc/trusted-signers, one per line:
+//
+//	ed25519:<base64 public key> <name>
+//
+// Once that file exists, smudge and doctor warn about blobs that are not
+// signed by one of them, and 'gitenc verify-signatures' checks them all.
+
+const (
+	ed25519Prefix     = "ed25519:"
+	signingKeyPrefix  = "GITENC-ED25519-SIGNING-KEY:"
+	signatureContext  = "gitenc blob signature\x00"
+	trustedSignerFile = "/.gitenc/trusted-signers"
+)
+
+var errUnsigned = errors.New("not signed")
+
+func DefaultSigningKeyPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "gitenc", "signing-key")
+}
+
+func signingKeyPath() string {
+	if path := GetGitConfig("gitenc.signingkey"); path != "" {
+		return path
+	}
+	return DefaultSigningKeyPath()
+}
+
+func formatSigner(publicKey []byte) string {
+	return ed25519Prefix + base64.StdEncoding.EncodeToString(publicKey)
+}
+
+func parseSigner(s string) (ed25519.PublicKey, error) {
+	if !strings.HasPrefix(s, ed25519Prefix) {
+		return nil, fmt.Errorf("unknown signer type: %s", s)
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(s[len(ed25519Prefix):])
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid ed25519 signer: %s", s)
+	}
+	return publicKey, nil
+}
+
+func newSigningKey(output string) (ed25519.PrivateKey, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(output), 0700); err != nil {
+		return nil, err
+	}
+	content := fmt.Sprintf("# public key: %s\n%s%s\n", formatSigner(publicKey), signingKeyPrefix, base64.StdEncoding.EncodeToString(privateKey.Seed()))
+	return privateKey, os.WriteFile(output, []byte(content), 0600)
+}
+
+func readSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, signingKeyPrefix) {
+			seed, err := base64.StdEncoding.DecodeString(line[len(signingKeyPrefix):])
+			if err != nil || len(seed) != ed25519.SeedSize {
+				return nil, errors.New("invalid ed25519 signing key")
+			}
+			return ed25519.NewKeyFromSeed(seed), nil
+		}
+	}
+	return nil, errors.New("no signing key found")
+}
+
+// repoSigningKey returns the key clean signs with, nil when the repository
+// does not sign.
+func repoSigningKey() (ed25519.PrivateKey, error) {
+	if GetGitConfig("gitenc.sign") != "true" {
+		return nil, nil
+	}
+	key, err := readSigningKey(signingKeyPath())
+	if os.IsNotExist(err) {
+		return nil, errors.New("gitenc.sign is set but there is no signing key, run 'gitenc keygen -sign' to create one")
+	}
+	return key, err
+}
+
+func signedMessage(digest []byte) []byte {
+	return append([]byte(signatureContext), digest...)
+}
+
+// signatureReader passes a signed payload on without the signature at its
+// end, which is checked once the payload was read.
+type signatureReader struct {
+	r       io.Reader
+	signer  ed25519.PublicKey
+	digest  hash.Hash
+	buf     []byte
+	pending []byte
+	err     error
+}
+
+func newSignatureReader(r io.Reader, header *Header) *signatureReader {
+	s := &signatureReader{
+		r:      r,
+		signer: header.Signer,
+		digest: sha512.New(),
+		buf:    make([]byte, 32*1024+ed25519.SignatureSize),
+	}
+	s.digest.Write(header.Raw())
+	return s
+}
+
+func (s *signatureReader) Read(b []byte) (int, error) {
+	for len(s.pending) <= ed25519.SignatureSize {
+		if s.err != nil {
+			return 0, s.err
+		}
+		// keep what may be the signature and read on behind it
+		n := copy(s.buf, s.pending)
+		m, err := s.r.Read(s.buf[n:])
+		s.pending = s.buf[:n+m]
+		if err == io.EOF {
+			s.err = s.verify()
+		} else if err != nil {
+			s.err = err
+		}
+	}
+	n := copy(b, s.pending[:len(s.pending)-ed25519.SignatureSize])
+	s.digest.Write(b[:n])
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *signatureReader) verify() error {
+	if len(s.pending) != ed25519.SignatureSize || len(s.signer) != ed25519.PublicKeySize {
+		return errors.New("signature is missing")
+	}
+	if !ed25519.Verify(s.signer, signedMessage(s.digest.Sum(nil)), s.pending) {
+		return fmt.Errorf("bad signature from %s", formatSigner(s.signer))
+	}
+	s.pending = nil
+	return io.EOF
+}
+
+// readTrustedSigners maps the trusted keys to their names.
+func readTrustedSigners() (map[string]string, error) {
+	data, err := readCommittedFile(trustedSignerFile)
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	trusted := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		signer, name, _ := strings.Cut(line, " ")
+		if _, err := parseSigner(signer); err != nil {
+			return nil, err
+		}
+		trusted[signer] = strings.TrimSpace(name)
+	}
+	return trusted, nil
+}
+
+var (
+	trustedOnce    sync.Once
+	trustedSigners map[string]string
+)
+
+// checkSigner reports a blob that is not signed by a trusted key. Nothing is
+// reported in repositories without trusted signers.
+func checkSigner(header *Header) error {
+	trustedOnce.Do(func() {
+		var err error
+		if trustedSigners, err = readTrustedSigners(); err != nil {
+			log.Warning("Error reading trusted signers", err)
+		}
+	})
+	if len(trustedSigners) == 0 {
+		return nil
+	}
+	if !header.Signed() {
+		return errUnsigned
+	}
+	if _, ok := trustedSigners[formatSigner(header.Signer)]; !ok {
+		return fmt.Errorf("signed by untrusted key %s", formatSigner(header.Signer))
+	}
+	return nil
+}
+
+// Trust adds signer, or the user's own signing key, to the trusted signers
+// and commits the file.
+func Trust(signer string, name string) {
+	if signer == "" {
+		key, err := readSigningKey(signingKeyPath())
+		if err != nil {
+			log.Error("Error reading signing key", err)
+			return
+		}
+		signer = formatSigner(key.Public().(ed25519.PublicKey))
+		if name == "" {
+			name = GetGitConfig("user.email")
+		}
+	}
+	if _, err := parseSigner(signer); err != nil {
+		log.Error(err)
+		return
+	}
+	trusted, err := readTrustedSigners()
+	if err != nil {
+		log.Error("Error reading trusted signers", err)
+		return
+	}
+	if _, ok := trusted[signer]; ok {
+		log.Info(signer, "is already trusted")
+		return
+	}
+	path := getRepoRoot() + trustedSignerFile
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Error("Error writing trusted signers", err)
+		return
+	}
+	data, _ := os.ReadFile(path)
+	if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+		data = append(data, '\n')
+	}
+	data = append(data, strings.TrimSpace(signer+" "+name)+"\n"...)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		log.Error("Error writing trusted signers", err)
+		return
+	}
+	if err := ensureGitencAttributes(); err != nil {
+		log.Error("Error updating .gitattributes", err)
+		return
+	}
+	if err := commitGitencFiles("Trust gitenc signer "+strings.TrimSpace(name+" "+signer), path); err != nil {
+		log.Error("Error committing", err)
+		return
+	}
+	log.Info("Signatures of", signer, "are trusted")
+}
+
+// VerifySignatures checks the signatures of all encrypted blobs in the index,
+// or in rev, and exits with an error when any is unsigned, untrusted or bad.
+func VerifySignatures(rev string) {
+	trusted, err := readTrustedSigners()
+	if err != nil {
+		log.Error("Error reading trusted signers", err)
+		os.Exit(1)
+	}
+	if len(trusted) == 0 {
+		log.Warning("No trusted signers in", trustedSignerFile[1:]+", run 'gitenc trust' to add one")
+	}
+	// git ls-files -s -z / git ls-tree -r -z rev
+	args := []string{"ls-files", "-s", "-z"}
+	if rev != "" {
+		args = []string{"ls-tree", "-r", "-z", rev}
+	}
+	code, output := RunCommand("git", args...)
+	if code != 0 {
+		log.Error(output)
+		os.Exit(1)
+	}
+	good, bad := 0, 0
+	for _, entry := range strings.Split(output, "\000") {
+		info, file, ok := strings.Cut(entry, "\t")
+		fields := strings.Fields(info)
+		if !ok || len(fields) < 3 {
+			continue
+		}
+		// ls-files lists mode, object and stage, ls-tree mode, type and object
+		object := fields[1]
+		if rev != "" {
+			object = fields[2]
+		}
+		header, err := verifyBlobSignature(object)
+		switch {
+		case err == ErrNotEncrypted:
+			continue
+		case err != nil:
+			log.Error(file+":", err)
+		case !header.Signed():
+			log.Warning(file+":", errUnsigned)
+		default:
+			signer := formatSigner(header.Signer)
+			if name, ok := trusted[signer]; ok {
+				log.Info(file+": good signature from", strings.TrimSpace(name+" "+signer))
+				good++
+				continue
+			}
+			log.Warning(file+": signed by untrusted key", signer)
+		}
+		bad++
+	}
+	log.Info(good, "good signatures,", bad, "blobs unsigned, untrusted or bad")
+	if bad > 0 {
+		os.Exit(1)
+	}
+}
+
+// verifyBlobSignature reads a git object to the end, which checks its
+// signature when it is signed.
+func verifyBlobSignature(object string) (*Header, error) {
+	// git cat-file blob object_id
+	cmd := exec.Command("git", "cat-file", "blob", object)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	defer cmd.Wait()
+	in := bufio.NewReaderSize(out, MaxPeekSize)
+	header, size, err := PeekHeader(in)
+	if err != nil {
+		io.Copy(io.Discard, in)
+		return nil, err
+	}
+	payload, err := header.OpenPayload(in, size)
+	if err == nil {
+		_, err = io.Copy(io.Discard, payload)
+	}
+	io.Copy(io.Discard, in)
+	return header, err
+}
@@ -0,0 +1,214 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Streamed payloads start with a 16 byte salt, which together with the key
+// gives a per-blob stream key. The data is then split into chunks of
+// ChunkSize bytes, each sealed on its own. The nonce of a chunk is its
+// big-endian counter followed by a byte that is 1 for the last chunk only,
+// so dropped, reordered or appended chunks fail to open.
+
+const (
+	ChunkSize  = 64 * 1024
+	SaltSize   = 16
+	lastChunk  = 1
+	maxCounter = 1<<32 - 1
+)
+
+var errTruncated = errors.New("encrypted stream is truncated")
+
+func newStreamAEAD(suite *CipherSuite, key []byte, salt []byte) (cipher.AEAD, error) {
+	streamKey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte("gitenc stream")), streamKey); err != nil {
+		return nil, err
+	}
+	return suite.New(streamKey)
+}
+
+func chunkNonce(nonce []byte, counter uint32, last bool) []byte {
+	for i := range nonce {
+		nonce[i] = 0
+	}
+	binary.BigEndian.PutUint32(nonce[len(nonce)-5:], counter)
+	if last {
+		nonce[len(nonce)-1] = lastChunk
+	}
+	return nonce
+}
+
+type StreamWriter struct {
+	aead    cipher.AEAD
+	ad      []byte
+	w       io.Writer
+	buf     []byte
+	nonce   []byte
+	counter uint32
+}
+
+// NewStreamWriter writes salt to w and returns a writer that encrypts
+// everything written to it, authenticating every chunk together with ad.
+// Close must be called to seal the last chunk.
+func NewStreamWriter(w io.Writer, suite *CipherSuite, key []byte, salt []byte, ad []byte) (*StreamWriter, error) {
+	aead, err := newStreamAEAD(suite, key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(salt); err != nil {
+		return nil, err
+	}
+	return &StreamWriter{
+		aead:  aead,
+		ad:    ad,
+		w:     w,
+		buf:   make([]byte, 0, ChunkSize+aead.Overhead()),
+		nonce: make([]byte, aead.NonceSize()),
+	}, nil
+}
+
+func (s *StreamWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed once more data shows it is not the last
+		if len(s.buf) == ChunkSize {
+			if err := s.flush(false); err != nil {
+				return n, err
+			}
+		}
+		m := copy(s.buf[len(s.buf):ChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+m]
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
+
+func (s *StreamWriter) flush(last bool) error {
+	if s.counter == maxCounter {
+		return errors.New("encrypted stream is too large")
+	}
+	sealed := s.aead.Seal(s.buf[:0], chunkNonce(s.nonce, s.counter, last), s.buf, s.ad)
+	if _, err := s.w.Write(sealed); err != nil {
+		return err
+	}
+	s.buf = s.buf[:0]
+	s.counter++
+	return nil
+}
+
+func (s *StreamWriter) Close() error {
+	return s.flush(true)
+}
+
+type StreamReader struct {
+	aead    cipher.AEAD
+	ad      []byte
+	salt    []byte
+	r       *bufio.Reader
+	chunk   []byte
+	buf     []byte
+	plain   []byte
+	nonce   []byte
+	counter uint32
+	done    bool
+}
+
+// NewStreamReader reads the salt from r and returns a reader that yields
+// the decrypted stream. It reports an error instead of io.EOF when the
+// stream ends before its last chunk.
+func NewStreamReader(r io.Reader, suite *CipherSuite, key []byte, ad []byte) (*StreamReader, error) {
+	salt := make([]byte, SaltSize)
+	if _, err := io.ReadFull(r, salt); err != nil {
+		return nil, errTruncated
+	}
+	aead, err := newStreamAEAD(suite, key, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamReader{
+		aead:  aead,
+		ad:    ad,
+		salt:  salt,
+		r:     bufio.NewReaderSize(r, ChunkSize+aead.Overhead()),
+		chunk: make([]byte, ChunkSize+aead.Overhead()),
+		buf:   make([]byte, ChunkSize),
+		nonce: make([]byte, aead.NonceSize()),
+	}, nil
+}
+
+func (s *StreamReader) Salt() []byte {
+	return s.salt
+}
+
+func (s *StreamReader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+func (s *StreamReader) next() error {
+	n, err := io.ReadFull(s.r, s.chunk)
+	last := false
+	switch err {
+	case nil:
+		_, err = s.r.Peek(1)
+		last = err == io.EOF
+	case io.ErrUnexpectedEOF:
+		last = true
+	case io.EOF:
+		return errTruncated
+	default:
+		return err
+	}
+	if n < s.aead.Overhead() {
+		return errTruncated
+	}
+	plain, err := s.aead.Open(s.buf[:0], chunkNonce(s.nonce, s.counter, last), s.chunk[:n], s.ad)
+	if err != nil {
+		// a chunk that opens as an inner one means the rest was cut off
+		if _, inner := s.aead.Open(s.buf[:0], chunkNonce(s.nonce, s.counter, false), s.chunk[:n], s.ad); last && inner == nil {
+			return errTruncated
+		}
+		return err
+	}
+	s.plain = plain
+	s.counter++
+	s.done = last
+	return nil
+}
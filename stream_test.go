@@ -0,0 +1,149 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+var testStreamAD = []byte("header")
+
+func sealStream(t *testing.T, suite *CipherSuite, key, data []byte) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	w, err := NewStreamWriter(&out, suite, key, make([]byte, SaltSize), testStreamAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func openStream(suite *CipherSuite, key, sealed, ad []byte) ([]byte, error) {
+	r, err := NewStreamReader(bytes.NewReader(sealed), suite, key, ad)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := randomBytes(t, 32)
+	for _, suite := range CipherSuites {
+		for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3 * ChunkSize} {
+			data := randomBytes(t, size)
+			sealed := sealStream(t, suite, key, data)
+			chunks := size/ChunkSize + 1
+			if size > 0 && size%ChunkSize == 0 {
+				chunks--
+			}
+			if want := SaltSize + size + chunks*16; len(sealed) != want {
+				t.Errorf("%s: %d bytes sealed to %d, want %d", suite.Name, size, len(sealed), want)
+			}
+			opened, err := openStream(suite, key, sealed, testStreamAD)
+			if err != nil {
+				t.Fatalf("%s: %d bytes: %v", suite.Name, size, err)
+			}
+			if !bytes.Equal(opened, data) {
+				t.Fatalf("%s: %d bytes do not round trip", suite.Name, size)
+			}
+			if _, err := openStream(suite, key, sealed, []byte("other")); err == nil {
+				t.Errorf("%s: %d bytes open with other associated data", suite.Name, size)
+			}
+		}
+	}
+}
+
+func TestStreamEmpty(t *testing.T) {
+	key := randomBytes(t, 32)
+	sealed := sealStream(t, DefaultCipherSuite, key, nil)
+	if len(sealed) != SaltSize+16 {
+		t.Fatalf("empty stream is %d bytes, want the salt and a sealed empty chunk", len(sealed))
+	}
+	if _, err := openStream(DefaultCipherSuite, key, sealed[:SaltSize], testStreamAD); err != errTruncated {
+		t.Errorf("stream without its only chunk returned %v, want %v", err, errTruncated)
+	}
+	if _, err := openStream(DefaultCipherSuite, key, nil, testStreamAD); err != errTruncated {
+		t.Errorf("stream without salt returned %v, want %v", err, errTruncated)
+	}
+}
+
+func TestStreamTruncated(t *testing.T) {
+	key := randomBytes(t, 32)
+	sealedChunk := ChunkSize + 16
+	for _, size := range []int{2 * ChunkSize, 2*ChunkSize + 10, 3 * ChunkSize} {
+		sealed := sealStream(t, DefaultCipherSuite, key, randomBytes(t, size))
+		// cut at every chunk boundary before the end
+		for end := SaltSize + sealedChunk; end < len(sealed); end += sealedChunk {
+			if _, err := openStream(DefaultCipherSuite, key, sealed[:end], testStreamAD); err != errTruncated {
+				t.Errorf("%d bytes cut at %d of %d returned %v, want %v", size, end, len(sealed), err, errTruncated)
+			}
+		}
+		if _, err := openStream(DefaultCipherSuite, key, sealed[:len(sealed)-1], testStreamAD); err == nil {
+			t.Errorf("%d bytes open with the last byte cut", size)
+		}
+	}
+}
+
+func TestStreamReordered(t *testing.T) {
+	key := randomBytes(t, 32)
+	sealedChunk := ChunkSize + 16
+	sealed := sealStream(t, DefaultCipherSuite, key, randomBytes(t, 3*ChunkSize))
+	first := sealed[SaltSize : SaltSize+sealedChunk]
+	second := sealed[SaltSize+sealedChunk : SaltSize+2*sealedChunk]
+	reordered := append(append(append(append([]byte{}, sealed[:SaltSize]...), second...), first...), sealed[SaltSize+2*sealedChunk:]...)
+	if _, err := openStream(DefaultCipherSuite, key, reordered, testStreamAD); err == nil {
+		t.Error("stream opens with its first two chunks swapped")
+	}
+}
+
+func TestStreamAppended(t *testing.T) {
+	key := randomBytes(t, 32)
+	sealedChunk := ChunkSize + 16
+	for _, size := range []int{ChunkSize, 2 * ChunkSize, 2*ChunkSize + 10} {
+		sealed := sealStream(t, DefaultCipherSuite, key, randomBytes(t, size))
+		// a chunk of the stream itself or of another stream of the same key
+		other := sealStream(t, DefaultCipherSuite, key, randomBytes(t, ChunkSize))
+		for _, chunk := range [][]byte{sealed[SaltSize : SaltSize+sealedChunk], other[SaltSize:], {0}} {
+			appended := append(append([]byte{}, sealed...), chunk...)
+			if _, err := openStream(DefaultCipherSuite, key, appended, testStreamAD); err == nil {
+				t.Errorf("%d bytes open with %d bytes appended", size, len(chunk))
+			}
+		}
+	}
+}
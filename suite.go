@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// CipherSuite is an AEAD that blobs can be sealed with. Its id is recorded
+// in the header, so readers pick the right one on their own.
+type CipherSuite struct {
+	ID   byte
+	Name string
+	New  func(key []byte) (cipher.AEAD, error)
+}
+
+var CipherSuites = []*CipherSuite{
+	{CipherAES256GCM, "aes-256-gcm", newAESGCM},
+	{CipherXChaCha20Poly1305, "xchacha20-poly1305", chacha20poly1305.NewX},
+}
+
+var DefaultCipherSuite = CipherSuites[0]
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func CipherSuiteByID(id byte) (*CipherSuite, error) {
+	for _, suite := range CipherSuites {
+		if suite.ID == id {
+			return suite, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported cipher %d", id)
+}
+
+func CipherSuiteByName(name string) (*CipherSuite, error) {
+	if name == "" {
+		return DefaultCipherSuite, nil
+	}
+	for _, suite := range CipherSuites {
+		if suite.Name == name {
+			return suite, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown cipher: %s", name)
+}
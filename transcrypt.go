@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// transcrypt encrypts files with 'openssl enc -<cipher> -md MD5 -a' and a
+// salt derived from the file, so its blobs are the base64 of:
+//
+//	"Salted__" | salt (8) | ciphertext
+//
+// The key and IV come from OpenSSL's EVP_BytesToKey with MD5 over the
+// password and salt, the ciphertext is AES-CBC with PKCS#7 padding. There
+// is no MAC, a wrong password mostly shows as bad padding. The password and
+// cipher are kept in git config transcrypt.password and transcrypt.cipher
+// of repositories configured with transcrypt. Newer versions may also set
+// transcrypt.digest for another -md and transcrypt.use-pbkdf2, which
+// derives the key and IV with PBKDF2 over that digest instead.
+
+const transcryptDriver = "crypt"
+
+var (
+	transcryptMagic = []byte("Salted__")
+	// transcryptPrefix is "Salted__" in base64
+	transcryptPrefix = []byte("U2FsdGVk")
+
+	transcryptCiphers = map[string]int{
+		"aes-128-cbc": 16,
+		"aes-192-cbc": 24,
+		"aes-256-cbc": 32,
+	}
+
+	transcryptDigests = map[string]func() hash.Hash{
+		"md5":    md5.New,
+		"sha1":   sha1.New,
+		"sha224": sha256.New224,
+		"sha256": sha256.New,
+		"sha384": sha512.New384,
+		"sha512": sha512.New,
+	}
+)
+
+// transcryptPBKDF2Iterations is the count 'openssl enc -pbkdf2' uses when
+// it is not given -iter, as transcrypt does.
+const transcryptPBKDF2Iterations = 10000
+
+// transcryptKDF derives the key and IV of a blob from the password and its
+// salt.
+type transcryptKDF func(password, salt []byte, keySize, ivSize int) ([]byte, []byte)
+
+// evpBytesToKey derives a key and IV the way 'openssl enc -md <digest>'
+// does without -pbkdf2.
+func evpBytesToKey(digest func() hash.Hash) transcryptKDF {
+	return func(password, salt []byte, keySize, ivSize int) ([]byte, []byte) {
+		var derived, block []byte
+		for len(derived) < keySize+ivSize {
+			h := digest()
+			h.Write(block)
+			h.Write(password)
+			h.Write(salt)
+			block = h.Sum(nil)
+			derived = append(derived, block...)
+		}
+		return derived[:keySize], derived[keySize : keySize+ivSize]
+	}
+}
+
+// opensslPBKDF2 derives a key and IV the way 'openssl enc -pbkdf2 -md
+// <digest>' does.
+func opensslPBKDF2(digest func() hash.Hash) transcryptKDF {
+	return func(password, salt []byte, keySize, ivSize int) ([]byte, []byte) {
+		derived := pbkdf2.Key(password, salt, transcryptPBKDF2Iterations, keySize+ivSize, digest)
+		return derived[:keySize], derived[keySize:]
+	}
+}
+
+func isTranscryptBlob(blob []byte) bool {
+	return bytes.HasPrefix(blob, transcryptPrefix)
+}
+
+func transcryptDecrypt(blob []byte, password string, keySize int, kdf transcryptKDF) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(blob)), ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid transcrypt blob: %v", err)
+	}
+	if !bytes.HasPrefix(data, transcryptMagic) || len(data) < 16+aes.BlockSize || (len(data)-16)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid transcrypt blob")
+	}
+	key, iv := kdf([]byte(password), data[8:16], keySize, aes.BlockSize)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(data)-16)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, data[16:])
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errors.New("bad padding, the transcrypt password, cipher or digest is wrong")
+	}
+	for _, b := range plaintext[len(plaintext)-padding:] {
+		if int(b) != padding {
+			return nil, errors.New("bad padding, the transcrypt password, cipher or digest is wrong")
+		}
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+// transcryptSource uses password and cipherName, or those transcrypt keeps
+// in the git config.
+func transcryptSource(password, cipherName string) (*migrationSource, error) {
+	if password == "" {
+		password = GetGitConfig("transcrypt.password")
+	}
+	if password == "" {
+		return nil, errors.New("no transcrypt password configured, pass it with -from-key")
+	}
+	if cipherName == "" {
+		cipherName = GetGitConfig("transcrypt.cipher")
+	}
+	if cipherName == "" {
+		cipherName = "aes-256-cbc"
+	}
+	keySize, ok := transcryptCiphers[cipherName]
+	if !ok {
+		return nil, fmt.Errorf("unsupported transcrypt cipher %s, use aes-128-cbc, aes-192-cbc or aes-256-cbc", cipherName)
+	}
+	kdf, err := transcryptKeyDerivation(GetGitConfig("transcrypt.digest"), GetGitConfig("transcrypt.use-pbkdf2"))
+	if err != nil {
+		return nil, err
+	}
+	return &migrationSource{
+		Name:        "transcrypt",
+		Driver:      transcryptDriver,
+		IsEncrypted: isTranscryptBlob,
+		Decrypt: func(blob []byte) ([]byte, error) {
+			return transcryptDecrypt(blob, password, keySize, kdf)
+		},
+	}, nil
+}
+
+// transcryptKeyDerivation returns the key derivation of git config
+// transcrypt.digest and transcrypt.use-pbkdf2.
+func transcryptKeyDerivation(digestName, usePBKDF2 string) (transcryptKDF, error) {
+	if digestName == "" {
+		digestName = "md5"
+	}
+	digest, ok := transcryptDigests[strings.ToLower(digestName)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported transcrypt digest %s, use md5, sha1, sha224, sha256, sha384 or sha512", digestName)
+	}
+	switch strings.ToLower(usePBKDF2) {
+	case "", "false", "no", "off", "0":
+		return evpBytesToKey(digest), nil
+	case "true", "yes", "on", "1":
+		return opensslPBKDF2(digest), nil
+	}
+	return nil, fmt.Errorf("invalid transcrypt.use-pbkdf2 %q", usePBKDF2)
+}
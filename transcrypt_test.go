@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Blobs made with
+//
+//	printf %s "$plaintext" | openssl enc -<cipher> -md <digest> [-pbkdf2] -pass pass:"correct horse" -a -A
+//
+// by OpenSSL 3.0.
+const (
+	transcryptTestPassword  = "correct horse"
+	transcryptTestPlaintext = "gitenc transcrypt known answer, longer than one block"
+)
+
+var transcryptTests = []struct {
+	cipher, digest, pbkdf2 string
+	blob                   string
+}{
+	{"aes-256-cbc", "", "", "U2FsdGVkX1/L/M6tlKj5YzlPjOA0cYP5wEJeq95ovXQGkqC3kb7jOm0Y/IhS1tFMFJqXXtl/njBibn2CS5aitybe6tDb57hMTljRUbQce70="},
+	{"aes-128-cbc", "md5", "false", "U2FsdGVkX19AqUwEdhELl4MxfrD/MtgQ2aoaCxQMjAatOevNZrSDiQ0pKWkqVcNFH38MNWOdzMTRnnlKs22aWsutdKGgwa8j6EJiobA3DJ8="},
+	{"aes-256-cbc", "sha256", "", "U2FsdGVkX1+X2sirTlbMVfT+A7jRwjTNBcnlxbCqFjiGtgmxJu0+GWVFH7FFGG7nnJlZnpLAITODz0VJ+cL7TPU+kllX+8jkQnh/C1wka5Y="},
+	{"aes-256-cbc", "sha512", "true", "U2FsdGVkX1+Jj+8QAse1dzySODQEK7d6PghiurndHXg7OVpABPH1tyzBgdCQsP1k1vvZ45haVamv/sJTHFggDUXdnMdRpihG1cr6j7qPqm8="},
+	{"aes-192-cbc", "SHA256", "true", "U2FsdGVkX18SgSxDBT8hDFOtDix3ZBv+LSrjWL6Ky7xlVJooxRyiij8GaBXpKO468WrlSPs+hacbv8Chco4OO3X8ZqoVMk8HZf0tUPYG85g="},
+}
+
+func TestTranscryptDecrypt(t *testing.T) {
+	for _, test := range transcryptTests {
+		kdf, err := transcryptKeyDerivation(test.digest, test.pbkdf2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob := []byte(test.blob)
+		if !isTranscryptBlob(blob) {
+			t.Errorf("%s %s: not seen as a transcrypt blob", test.cipher, test.digest)
+		}
+		plaintext, err := transcryptDecrypt(blob, transcryptTestPassword, transcryptCiphers[test.cipher], kdf)
+		if err != nil {
+			t.Errorf("%s %s pbkdf2=%s: %v", test.cipher, test.digest, test.pbkdf2, err)
+		} else if string(plaintext) != transcryptTestPlaintext {
+			t.Errorf("%s %s pbkdf2=%s: decrypted %q", test.cipher, test.digest, test.pbkdf2, plaintext)
+		}
+		// the defaults of older transcrypt versions do not fit the others
+		if test.digest != "" && !strings.EqualFold(test.digest, "md5") {
+			if _, err := transcryptDecrypt(blob, transcryptTestPassword, transcryptCiphers[test.cipher], evpBytesToKey(transcryptDigests["md5"])); err == nil {
+				t.Errorf("%s %s: decrypted with the md5 key derivation", test.cipher, test.digest)
+			}
+		}
+	}
+}
+
+func TestTranscryptWrongPassword(t *testing.T) {
+	kdf, _ := transcryptKeyDerivation("", "")
+	if _, err := transcryptDecrypt([]byte(transcryptTests[0].blob), "wrong", 32, kdf); err == nil {
+		t.Error("decrypted with the wrong password")
+	}
+}
+
+func TestTranscryptKeyDerivationInvalid(t *testing.T) {
+	if _, err := transcryptKeyDerivation("whirlpool", ""); err == nil {
+		t.Error("accepted an unsupported digest")
+	}
+	if _, err := transcryptKeyDerivation("", "maybe"); err == nil {
+		t.Error("accepted an invalid use-pbkdf2")
+	}
+}
@@ -0,0 +1,324 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	log "gitenc/log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const gitencAttributes = ".gitenc/** !filter !diff"
+
+func Keygen(cmd KeygenCommand) {
+	if cmd.Sign {
+		keygenSigning(cmd.Output)
+		return
+	}
+	output := cmd.Output
+	if output == "" {
+		output = DefaultIdentityPath()
+	}
+	if _, err := os.Stat(output); err == nil {
+		log.Error("Identity already exists:", output)
+		return
+	}
+	identity, err := NewX25519Identity()
+	if err != nil {
+		log.Error("Error generating identity", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(output), 0700); err != nil {
+		log.Error("Error creating identity directory", err)
+		return
+	}
+	content := fmt.Sprintf("# public key: %s\n%s\n", identity.Recipient(), identity)
+	if err := os.WriteFile(output, []byte(content), 0600); err != nil {
+		log.Error("Error writing identity", err)
+		return
+	}
+	log.Info("Identity written to", output)
+	log.Info("Public key:", identity.Recipient())
+}
+
+func keygenSigning(output string) {
+	if output == "" {
+		output = DefaultSigningKeyPath()
+	}
+	if _, err := os.Stat(output); err == nil {
+		log.Error("Signing key already exists:", output)
+		return
+	}
+	key, err := newSigningKey(output)
+	if err != nil {
+		log.Error("Error writing signing key", err)
+		return
+	}
+	log.Info("Signing key written to", output)
+	log.Info("Public key:", formatSigner(key.Public().(ed25519.PublicKey)))
+}
+
+// ensureGitencAttributes keeps the files under .gitenc/ out of the filter,
+// they have to be readable before the repository is unlocked.
+func ensureGitencAttributes() error {
+	path := getRepoRoot() + "/.gitattributes"
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == gitencAttributes {
+			return nil
+		}
+	}
+	if len(data) > 0 && !strings.HasSuffix(string(data), "\n") {
+		data = append(data, '\n')
+	}
+	return os.WriteFile(path, append(data, gitencAttributes+"\n"...), 0644)
+}
+
+// readCommittedFile reads path, relative to the repository root like
+// "/.gitenc/repoid", from the working tree. During a checkout the file may
+// not be written yet, then it is read from HEAD.
+func readCommittedFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(getRepoRoot() + path)
+	if !os.IsNotExist(err) {
+		return data, err
+	}
+	// git cat-file blob HEAD:.gitenc/file
+	code, output := RunCommand("git", "cat-file", "blob", "HEAD:"+strings.TrimPrefix(path, "/"))
+	if code != 0 {
+		return nil, err
+	}
+	return []byte(output), nil
+}
+
+// commitGitencFiles commits files under .gitenc/ together with
+// .gitattributes, leaving anything else in the index alone.
+func commitGitencFiles(message string, files ...string) error {
+	files = append(files, getRepoRoot()+"/.gitattributes")
+	// git add -- files
+	if code, output := RunCommand("git", append([]string{"add", "--"}, files...)...); code != 0 {
+		return errors.New(output)
+	}
+	// git commit -m message -- files
+	if code, output := RunCommand("git", append([]string{"commit", "-m", message, "--"}, files...)...); code != 0 {
+		return errors.New(output)
+	}
+	return nil
+}
+
+func AddUser(command KeyCommand, value string) {
+	keyPath, keyName := GetKeyPath(command.KeyName)
+	keys, err := unlockKeys(keyPath, keyName)
+	if os.IsNotExist(err) {
+		log.Error("gitenc isnot initialized in this repository. Run 'gitenc init' to initialize it.")
+		return
+	} else if err != nil {
+		log.Error("Error reading key", err)
+		return
+	}
+	var recipients []Recipient
+	if command.SSH != "" {
+		// a .pub file or a whole authorized_keys file
+		recipients, err = readSSHRecipients(command.SSH)
+	} else {
+		var recipient Recipient
+		recipient, err = ParseRecipient(value)
+		recipients = []Recipient{recipient}
+	}
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	paths := make([]string, 0, len(recipients))
+	names := make([]string, 0, len(recipients))
+	for _, recipient := range recipients {
+		path, err := writeRecipient(keyName, recipient, keys)
+		if err != nil {
+			log.Error("Error wrapping key", err)
+			return
+		}
+		paths = append(paths, path)
+		names = append(names, filepath.Base(path))
+	}
+	if err := ensureGitencAttributes(); err != nil {
+		log.Error("Error updating .gitattributes", err)
+		return
+	}
+	if err := commitGitencFiles("Add gitenc user "+strings.Join(names, ", "), paths...); err != nil {
+		log.Error("Error committing", err)
+		return
+	}
+	for _, recipient := range recipients {
+		log.Info("Added", recipient, "to key", keyName)
+		if _, ok := recipient.(*TransitRecipient); ok {
+			log.Info("Clones unlock key", keyName, "through the KMS, the local key file is not needed anymore")
+		}
+	}
+}
+
+// RemoveUser drops a recipient and rotates the key, so that the removed
+// user cannot read anything committed from now on. The key ids they held
+// are recorded in .gitenc/revoked/<keyname> for doctor to check. With -ssh,
+// every key of the file that is a recipient is removed.
+func RemoveUser(command KeyCommand, value string) {
+	_, keyName := GetKeyPath(command.KeyName)
+	var candidates []string
+	if command.SSH != "" {
+		sshRecipients, err := readSSHRecipients(command.SSH)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		for _, recipient := range sshRecipients {
+			candidates = append(candidates, recipientFile(keyName, recipient))
+		}
+		value = command.SSH
+	} else {
+		path := recipientsDir(keyName) + value
+		if recipient, err := ParseRecipient(value); err == nil {
+			path = recipientFile(keyName, recipient)
+		}
+		candidates = []string{path}
+	}
+	var paths, recipients, names, revoked []string
+	for _, path := range candidates {
+		recipient, wrapped, err := readRecipient(path)
+		if err != nil {
+			continue
+		}
+		paths = append(paths, path)
+		recipients = append(recipients, recipient)
+		names = append(names, filepath.Base(path))
+		for _, key := range wrapped {
+			revoked = append(revoked, key.KeyID+" "+recipient)
+		}
+	}
+	if len(paths) == 0 {
+		log.Error("No such user:", value)
+		return
+	}
+	prepare := func(keys [][]byte) ([]string, error) {
+		for _, path := range paths {
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+		}
+		if err := appendRevoked(keyName, revoked); err != nil {
+			return nil, err
+		}
+		return append(paths, revokedFile(keyName)), nil
+	}
+	if err := rotateKey(command, "Remove gitenc user "+strings.Join(names, ", "), prepare); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	for _, recipient := range recipients {
+		log.Info("Removed", recipient, "from key", keyName)
+	}
+}
+
+func revokedFile(keyName string) string {
+	return getRepoRoot() + "/.gitenc/revoked/" + keyName
+}
+
+func appendRevoked(keyName string, lines []string) error {
+	if err := os.MkdirAll(filepath.Dir(revokedFile(keyName)), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(revokedFile(keyName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(strings.Join(lines, "\n") + "\n")
+	return err
+}
+
+// revokedKeys maps the hex ids of revoked keys, of any key name, to the
+// recipient they were revoked from.
+func revokedKeys() map[string]string {
+	revoked := make(map[string]string)
+	dir := getRepoRoot() + "/.gitenc/revoked/"
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		data, err := os.ReadFile(dir + entry.Name())
+		if err != nil {
+			continue
+		}
+		parseRevoked(string(data), revoked)
+	}
+	return revoked
+}
+
+// parseRevoked adds the "<key id> <recipient>" lines of a revoked file to
+// revoked. Recipients such as SSH keys hold spaces themselves.
+func parseRevoked(data string, revoked map[string]string) {
+	for _, line := range strings.Split(data, "\n") {
+		keyID, recipient, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if ok && keyID != "" && recipient != "" {
+			revoked[keyID] = strings.TrimSpace(recipient)
+		}
+	}
+}
+
+// unlockWithIdentity recovers the keys of keyName from the recipients
+// directory. Anyone can commit a recipient file, so the keys must decrypt
+// the encrypted files, and a different local key is only replaced with
+// force or when the recovered keyring holds it, as after a rotation.
+func unlockWithIdentity(keyPath, keyName, identityPath string, force bool) error {
+	data, err := os.ReadFile(identityPath)
+	if err != nil {
+		return err
+	}
+	var identity Identity
+	if isSSHIdentity(data) {
+		identity, err = parseSSHIdentity(data, identityPath)
+	} else {
+		identity, err = ParseIdentity(data)
+	}
+	if err != nil {
+		return err
+	}
+	keys, err := unwrapKeys(keyName, identity)
+	if err != nil {
+		return err
+	}
+	if _, err := verifyKeys(keyName, keys); err != nil {
+		return err
+	}
+	if current, err := readKeyFile(keyPath + keyName); err == nil {
+		for _, key := range keys[1:] {
+			force = force || bytes.Equal(current, key)
+		}
+	}
+	if err := installKeys(keyPath, keyName, keys, &KDFParams{KDF: KDFNone}, force); err != nil {
+		return err
+	}
+	log.Info("Key", keyName, "unwrapped with", identityPath)
+	return nil
+}
@@ -0,0 +1,43 @@
+/*
+ * Copyright (c) 2023 Mrack
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ *
+ * This program is named gitenc and is distributed under the terms of
+ * the GNU General Public License, version 3 or any later version.
+ */
+
+package main
+
+import "testing"
+
+func TestParseRevoked(t *testing.T) {
+	revoked := make(map[string]string)
+	parseRevoked("9fa3947e8fa827a9b30b194953c36c1a x25519:rcoB/MPaWyTCFy+/93Rvk/49uxZBk2KOgSnE6XR2iB0=\n"+
+		"50686e121d5f0bd8a0c4e2b2f1e1e7d4 ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIPybaKL3IdjaJHwOBqRAd7T3NCQZ3NAVxxpIVQyAyCh4\n"+
+		"\n"+
+		"incomplete\n", revoked)
+	want := map[string]string{
+		"9fa3947e8fa827a9b30b194953c36c1a": "x25519:rcoB/MPaWyTCFy+/93Rvk/49uxZBk2KOgSnE6XR2iB0=",
+		"50686e121d5f0bd8a0c4e2b2f1e1e7d4": "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIPybaKL3IdjaJHwOBqRAd7T3NCQZ3NAVxxpIVQyAyCh4",
+	}
+	if len(revoked) != len(want) {
+		t.Fatalf("parsed %d revoked keys, want %d: %v", len(revoked), len(want), revoked)
+	}
+	for keyID, recipient := range want {
+		if revoked[keyID] != recipient {
+			t.Errorf("key %s revoked from %q, want %q", keyID, revoked[keyID], recipient)
+		}
+	}
+}
@@ -21,7 +21,10 @@
 package main
 
 import (
+	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"strings"
 )
 
@@ -41,6 +44,11 @@ func GetKeyPath(name string) (string, string) {
 	return GetGitPath() + "/gitenc/keys/", name
 }
 
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
 func Trim(s string) string {
 	return strings.Trim(strings.Trim(s, "\r"), "\n")
 }
@@ -51,3 +59,39 @@ func GetGitPath() string {
 	}
 	return Trim(path)
 }
+
+func GetGitConfig(key string) string {
+	code, value := RunCommand("git", "config", "--get", key)
+	if code != 0 {
+		return ""
+	}
+	return Trim(value)
+}
+
+// GetGitAttrs returns the values of attrs for path, leaving out those that
+// are not set to a value.
+func GetGitAttrs(path string, attrs ...string) map[string]string {
+	values := make(map[string]string)
+	if path == "" {
+		return values
+	}
+	// git check-attr -z attrs -- filename
+	code, output := RunCommand("git", append(append([]string{"check-attr", "-z"}, attrs...), "--", path)...)
+	if code != 0 {
+		return values
+	}
+	// path, attribute and value, each ended by NUL
+	fields := strings.Split(output, "\000")
+	for i := 0; i+2 < len(fields); i += 3 {
+		if value := fields[i+2]; value != "unspecified" && value != "set" && value != "unset" {
+			values[fields[i+1]] = value
+		}
+	}
+	return values
+}
+
+// NormalizePath turns a path relative to the repository root into the form
+// recorded in blob headers.
+func NormalizePath(p string) string {
+	return strings.TrimPrefix(path.Clean(filepath.ToSlash(p)), "./")
+}